@@ -0,0 +1,139 @@
+package cache
+
+// arcPolicy is the Adaptive Replacement Cache policy (Megiddo and Modha,
+// 2003). Keys seen once and keys seen more than once are kept in separate LRU
+// lists, and each list remembers keys it recently evicted. A request for a
+// remembered key shifts the target size of the lists towards the list that
+// shouldn't have evicted it, so the balance between recency and frequency
+// adapts to the traffic.
+//
+// Memory evicts before adding a key, so the target size adapts after the
+// eviction that made room for a remembered key, not before as in the paper
+type arcPolicy struct {
+	capacity       int
+	target         int      // p: the target size of recent
+	recent         *keyList // T1: cached keys seen once, most recently used first
+	frequent       *keyList // T2: cached keys seen more than once, most recently used first
+	recentGhosts   *keyList // B1: keys recently evicted from recent
+	frequentGhosts *keyList // B2: keys recently evicted from frequent
+}
+
+func newARCPolicy(capacity int) *arcPolicy {
+	return &arcPolicy{
+		capacity:       capacity,
+		recent:         newKeyList(),
+		frequent:       newKeyList(),
+		recentGhosts:   newKeyList(),
+		frequentGhosts: newKeyList(),
+	}
+}
+
+func (p *arcPolicy) Add(key string) {
+	switch {
+	case p.recentGhosts.Contains(key):
+		// recent was too small to keep this key, so grow it
+		delta := 1
+		if p.frequentGhosts.Len() > p.recentGhosts.Len() {
+			delta = p.frequentGhosts.Len() / p.recentGhosts.Len()
+		}
+
+		p.target += delta
+		if p.target > p.size() {
+			p.target = p.size()
+		}
+
+		p.recentGhosts.Remove(key)
+		p.frequent.PushFront(key)
+
+	case p.frequentGhosts.Contains(key):
+		// frequent was too small to keep this key, so shrink recent
+		delta := 1
+		if p.recentGhosts.Len() > p.frequentGhosts.Len() {
+			delta = p.recentGhosts.Len() / p.frequentGhosts.Len()
+		}
+
+		p.target -= delta
+		if p.target < 0 {
+			p.target = 0
+		}
+
+		p.frequentGhosts.Remove(key)
+		p.frequent.PushFront(key)
+
+	default:
+		p.recent.PushFront(key)
+	}
+
+	p.trimGhosts()
+}
+
+func (p *arcPolicy) Access(key string) {
+	if p.recent.Remove(key) {
+		p.frequent.PushFront(key)
+		return
+	}
+
+	p.frequent.MoveToFront(key)
+}
+
+func (p *arcPolicy) Remove(key string) {
+	if !p.recent.Remove(key) {
+		p.frequent.Remove(key)
+	}
+}
+
+func (p *arcPolicy) Evict() (key string) {
+	if p.recent.Len() > 0 && (p.recent.Len() > p.target || p.frequent.Len() == 0) {
+		key = p.recent.PopBack()
+		p.recentGhosts.PushFront(key)
+	} else {
+		key = p.frequent.PopBack()
+		p.frequentGhosts.PushFront(key)
+	}
+
+	p.trimGhosts()
+
+	return key
+}
+
+func (p *arcPolicy) Keys() []string {
+	return append(p.frequent.Keys(), p.recent.Keys()...)
+}
+
+func (p *arcPolicy) Clear() {
+	p.target = 0
+	p.recent.Clear()
+	p.frequent.Clear()
+	p.recentGhosts.Clear()
+	p.frequentGhosts.Clear()
+}
+
+// trimGhosts forgets the oldest evicted keys, so recent and its ghosts hold
+// at most the cache size, and all four lists at most twice the cache size
+func (p *arcPolicy) trimGhosts() {
+	size := p.size()
+
+	for p.recentGhosts.Len() > 0 && p.recent.Len()+p.recentGhosts.Len() > size {
+		p.recentGhosts.PopBack()
+	}
+
+	for p.frequentGhosts.Len() > 0 &&
+		p.recent.Len()+p.frequent.Len()+p.recentGhosts.Len()+p.frequentGhosts.Len() > 2*size {
+
+		p.frequentGhosts.PopBack()
+	}
+}
+
+// size is the capacity, or the number of cached keys if the cache only has a
+// byte limit
+func (p *arcPolicy) size() int {
+	if p.capacity > 0 {
+		return p.capacity
+	}
+
+	if size := p.recent.Len() + p.frequent.Len(); size > 0 {
+		return size
+	}
+
+	return 1
+}
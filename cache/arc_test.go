@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestARCPolicyOrder(t *testing.T) {
+	p := newARCPolicy(4)
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Add("d")
+	p.Access("a")
+	p.Access("b")
+
+	// keys seen once are evicted first, while the target for them is 0
+	if p.Evict() != "c" || p.Evict() != "d" {
+		t.Error("Keys seen once not evicted first")
+	}
+
+	// c was evicted too soon, so keys seen once get more room
+	p.Add("c")
+	p.Add("e")
+	if p.target != 1 {
+		t.Error("Target not increased", p.target)
+	}
+
+	checkOrder(t, "Keys", p.Keys(), []string{"c", "b", "a", "e"})
+
+	// e fits in the target, so a key seen twice is evicted instead
+	if p.Evict() != "a" {
+		t.Error("Keys seen twice not evicted")
+	}
+
+	// a was evicted too soon as well, so keys seen once get less room again
+	p.Add("a")
+	if p.target != 0 {
+		t.Error("Target not decreased", p.target)
+	}
+
+	checkOrder(t, "Eviction", evictAll(p), []string{"e", "b", "c", "a"})
+}
+
+func TestARCScanResistance(t *testing.T) {
+	m, err := NewMemory(1000, 4, WithPolicy(PolicyARC))
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+
+	m.Set("a", a)
+	m.Set("b", b)
+	m.Get("a")
+	m.Get("b")
+
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprintf("scan%v", i), []byte("x"))
+	}
+
+	if !cached(m, "a", a) || !cached(m, "b", b) {
+		t.Error("Hot keys flushed by a scan")
+	}
+}
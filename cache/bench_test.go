@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// Run with a high -cpu value to see lock contention, e.g.
+// go test -run none -bench . -cpu 1,8,64 ./cache
+
+const benchCapacity = 10000
+const benchKeys = 2 * benchCapacity
+
+var benchKeyNames = func() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%v", i)
+	}
+
+	return keys
+}()
+
+func benchmarkCache(b *testing.B, c Cache) {
+	value := []byte("value")
+	for _, key := range benchKeyNames[:benchCapacity] {
+		c.Set(key, value)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// start each goroutine somewhere different in the key space
+		i := rand.Intn(benchKeys)
+		for pb.Next() {
+			key := benchKeyNames[(i*7919)%benchKeys]
+
+			// mostly reads, falling back to a write on a miss like the proxy does
+			if c.Get(key) == nil {
+				c.Set(key, value)
+			}
+
+			i++
+		}
+	})
+}
+
+func BenchmarkLRU(b *testing.B) {
+	lru, err := NewLRU(60000, benchCapacity)
+	if err != nil {
+		panic(err)
+	}
+
+	benchmarkCache(b, lru)
+}
+
+func BenchmarkSharded16(b *testing.B) {
+	sharded, err := NewSharded(60000, benchCapacity, 16)
+	if err != nil {
+		panic(err)
+	}
+
+	benchmarkCache(b, sharded)
+}
+
+func BenchmarkSharded64(b *testing.B) {
+	sharded, err := NewSharded(60000, benchCapacity, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	benchmarkCache(b, sharded)
+}
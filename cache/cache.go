@@ -1,113 +1,673 @@
 package cache
 
 import (
-	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/go-redis/redis"
 )
 
 var ErrNegativeValues = errors.New("negative cache expiry and capacity values unsupported")
+var ErrUnbounded = errors.New("cache needs a key capacity, a byte limit, or both")
+var ErrInvalidJitter = errors.New("cache expiry jitter must be less than 1")
+
+// TransientPrefix starts keys that are only kept in memory. They're left out
+// of snapshots and never demoted to disk, so they don't outlive the process
+// that cached them, for entries keyed by state that's lost on restart
+const TransientPrefix = "\x00"
+
+// Cache is implemented by every cache the proxy can serve from. Caches that
+// can also be snapshotted, report stats, or estimate their room implement
+// Snapshotter, StatsReporter or Bounded, which callers check for
+type Cache interface {
+	// Get returns the entry cached for key, or nil if there is none
+	Get(key string) *Entry
+	// GetStale is like Get, but also returns entries that have expired within
+	// the cache's stale window, along with whether the entry is stale
+	GetStale(key string) (entry *Entry, stale bool)
+	// Peek is like Get, without counting it as a use
+	Peek(key string) *Entry
+	// PeekStale is like GetStale, without counting it as a use
+	PeekStale(key string) (entry *Entry, stale bool)
+	Set(key string, value []byte)
+	// SetWithTTL caches value for at most ttl, or the cache's own expiry if
+	// that's sooner. A ttl of 0 means the value has no TTL at its source
+	SetWithTTL(key string, value []byte, ttl time.Duration)
+	// SetFetched is like SetWithTTL, for a value fetched from its source as
+	// fetched describes. It returns the new entry, even if it was too large
+	// to keep
+	SetFetched(key string, value []byte, fetched Fetched) *Entry
+	// SetFetchedIf is like SetFetched, but first calls valid, with the cache
+	// locked, passing the entry cached for key, or nil if there's none that
+	// can still be served. The new entry is only cached if valid returns
+	// true, and it's returned either way, along with whether it was cached.
+	// valid mustn't use the cache
+	SetFetchedIf(key string, value []byte, fetched Fetched, valid func(current *Entry) bool) (*Entry, bool)
+	// Delete removes key from the cache, returning whether it was cached
+	Delete(key string) bool
+	Len() int
+	Clear()
+	// Close stops any background work the cache is doing
+	Close()
+}
+
+// Fetched describes how a value was fetched from its source, for SetFetched
+type Fetched struct {
+	TTL         time.Duration // remaining TTL at the source, 0 if none, see SetWithTTL
+	FetchTime   time.Duration // how long the value took to fetch, kept for Entry.ExpiresEarly
+	ContentType string        // the MIME type of the value, kept as Entry.ContentType
+}
+
+// Snapshotter is implemented by caches that can be saved to a snapshot, and
+// restored from one
+type Snapshotter interface {
+	// WriteSnapshot writes every live entry to w, in the snapshot format
+	WriteSnapshot(w io.Writer) error
+	// ReadSnapshot caches the entries in a snapshot read from r, skipping
+	// any that have expired since
+	ReadSnapshot(r io.Reader) error
+}
+
+// StatsReporter is implemented by caches that count their hits, misses, sets
+// and removals
+type StatsReporter interface {
+	// Stats returns a snapshot of the cache's counters
+	Stats() Stats
+	// ResetStats sets the cache's counters back to 0
+	ResetStats()
+}
+
+// Bounded is implemented by caches that can estimate how full they are
+type Bounded interface {
+	// Room returns how many more keys the cache can hold before it evicts
+	// any, estimated from the size of the entries cached so far if it has a
+	// byte limit, or -1 if there's nothing to estimate from
+	Room() int
+}
+
+// Entry is a cached value, along with metadata about how it was cached.
+// Entries are never modified once cached, so they're safe to read after Get
+type Entry struct {
+	Key         string
+	Value       []byte        // the value as stored, compressed if Encoding is set
+	Encoding    string        // the codec Value is compressed with, empty if it isn't
+	ContentType string        // the MIME type of the value, empty if it's unknown
+	ETag        string        // a strong ETag for Value as stored, a hash of it
+	Timestamp   time.Time     // when the entry was cached
+	Size        int           // size of key and stored value, in bytes
+	TTL         time.Duration // remaining TTL at the source when cached, 0 if none
+	Expires     time.Time     // when the entry expires, and can only be served stale
+	Tier        string        // the tier the entry was served from, TierMemory or TierDisk
+	FetchTime   time.Duration // how long the value took to fetch, 0 if unknown. Not kept in snapshots or on disk
+}
+
+// ExpiresEarly decides whether to refresh the entry before it expires, with
+// the XFetch algorithm (Vattani, Chierichetti and Lowenstein, 2015). The
+// chance rises as expiry approaches, and is higher for values that took
+// longer to fetch, scaled by beta. A beta of 1 is the usual choice, with
+// larger values refreshing earlier. Entries with no FetchTime never expire
+// early
+func (e *Entry) ExpiresEarly(beta float64, now time.Time) bool {
+	if e.FetchTime <= 0 || beta <= 0 {
+		return false
+	}
+
+	// 1 - Float64 is in (0, 1], so the log is finite
+	early := time.Duration(float64(e.FetchTime) * beta * -math.Log(1-rand.Float64()))
+
+	return !now.Add(early).Before(e.Expires)
+}
+
+// Cache tiers, for Entry.Tier
+const (
+	TierMemory = "memory"
+	TierDisk   = "disk"
+)
+
+// newEntry creates an entry cached at now, that expires after expiry, or after
+// the source TTL if that's sooner
+func newEntry(key string, value []byte, ttl time.Duration, expiry time.Duration, now time.Time) *Entry {
+	lifetime := expiry
+	if ttl > 0 && ttl < expiry {
+		lifetime = ttl
+	}
+
+	return &Entry{
+		Key:       key,
+		Value:     value,
+		Timestamp: now,
+		Size:      len(key) + len(value),
+		TTL:       ttl,
+		Expires:   now.Add(lifetime),
+		Tier:      TierMemory,
+	}
+}
+
+// Memory is an in-memory cache, bounded by key count, total bytes or both,
+// which evicts entries in the order its eviction policy chooses
+type Memory struct {
+	counters counters // first, for 64 bit alignment of atomic operations
 
-type element struct {
-	Timestamp time.Time
-	Key       string
-	Response  *redis.StringCmd
+	capacity    int
+	maxBytes    int64
+	bytes       int64
+	expiry      time.Duration
+	staleWindow time.Duration
+	jitter      float64
+	policy      policy
+	codec       codec
+	codecName   string
+	compressMin int // values must be larger than this many bytes to compress
+	lookup      map[string]*Entry
+	mutex       *sync.Mutex
+	janitor     *janitor
+	hooks       []entryHook
+	removed     []removal        // removed while the mutex is held, for the hooks
+	now         func() time.Time // the clock entries are timed by, replaced in tests
 }
 
-type LRU struct {
-	capacity int
-	expiry   time.Duration
-	list     *list.List
-	lookup   map[string]*list.Element
-	mutex    *sync.Mutex
+// NewMemory creates a cache holding at most capacity keys, each expiring after
+// expiry ms. A capacity of 0 leaves the key count unbounded, as long as a byte
+// limit is given with WithMaxBytes. Entries are evicted least recently used
+// first, unless another policy is given with WithPolicy
+func NewMemory(expiry int, capacity int, opts ...Option) (m *Memory, err error) {
+	return newMemory(expiry, capacity, newOptions(opts))
 }
 
-func NewLRU(expiry int, capacity int) (lru *LRU, err error) {
-	if expiry < 0 || capacity < 0 {
+// NewLRU creates a Memory cache that always evicts least recently used first
+func NewLRU(expiry int, capacity int, opts ...Option) (m *Memory, err error) {
+	return NewMemory(expiry, capacity, append(opts, WithPolicy(PolicyLRU))...)
+}
+
+func newMemory(expiry int, capacity int, o options) (m *Memory, err error) {
+	if expiry < 0 || capacity < 0 || o.negative() {
 		return nil, ErrNegativeValues
 	}
 
-	lru = &LRU{
-		capacity: capacity,
-		expiry:   time.Duration(expiry) * time.Millisecond,
-		lookup:   make(map[string]*list.Element, capacity),
-		list:     list.New(),
-		mutex:    &sync.Mutex{},
+	if capacity == 0 && o.maxBytes == 0 {
+		return nil, ErrUnbounded
+	}
+
+	if o.jitter >= 1 {
+		return nil, ErrInvalidJitter
+	}
+
+	evictionPolicy, err := newPolicy(o.policy, capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	valueCodec, err := newCodec(o.codec)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < capacity; i++ {
-		lru.list.PushFront(nil)
+	m = &Memory{
+		capacity:    capacity,
+		maxBytes:    o.maxBytes,
+		expiry:      time.Duration(expiry) * time.Millisecond,
+		staleWindow: o.staleWindow,
+		jitter:      o.jitter,
+		policy:      evictionPolicy,
+		codec:       valueCodec,
+		codecName:   o.codec,
+		compressMin: o.compressThreshold,
+		lookup:      make(map[string]*Entry, capacity),
+		mutex:       &sync.Mutex{},
+		hooks:       o.hooks,
+		now:         time.Now,
 	}
 
-	return lru, nil
+	if o.sweepInterval > 0 {
+		m.janitor = startJanitor(m.Sweep, o.sweepInterval, o.sweepSample)
+	}
+
+	return m, nil
 }
 
-func (lru *LRU) Set(key string, value *redis.StringCmd) {
-	lru.mutex.Lock()
-	defer lru.mutex.Unlock()
+func (m *Memory) Set(key string, value []byte) {
+	m.SetWithTTL(key, value, 0)
+}
 
-	cacheElement := element{
-		Timestamp: time.Now(),
-		Key:       key,
-		Response:  value,
+func (m *Memory) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	m.SetFetched(key, value, Fetched{TTL: ttl})
+}
+
+func (m *Memory) SetFetched(key string, value []byte, fetched Fetched) *Entry {
+	cacheElement, _ := m.SetFetchedIf(key, value, fetched, nil)
+	return cacheElement
+}
+
+func (m *Memory) SetFetchedIf(key string, value []byte, fetched Fetched, valid func(current *Entry) bool) (*Entry, bool) {
+	cacheElement := newEntry(key, value, fetched.TTL, m.expiry, m.now())
+	cacheElement.FetchTime = fetched.FetchTime
+	cacheElement.ContentType = fetched.ContentType
+	m.addJitter(cacheElement)
+
+	// compress and hash before locking, so other requests don't wait on it
+	m.compress(cacheElement)
+	cacheElement.ETag = etagFor(cacheElement.Value)
+
+	m.mutex.Lock()
+	defer m.unlock()
+
+	if valid != nil {
+		current := m.lookup[key]
+		if current != nil && m.dead(current, m.now()) {
+			current = nil
+		}
+
+		if !valid(current) {
+			return cacheElement, false
+		}
+	}
+
+	atomic.AddUint64(&m.counters.sets, 1)
+	m.setEntry(cacheElement)
+
+	return cacheElement, true
+}
+
+// setEntry caches an entry, with the mutex held
+func (m *Memory) setEntry(cacheElement *Entry) {
+	key := cacheElement.Key
+	size := int64(cacheElement.Size)
+
+	oldElement, exists := m.lookup[key]
+
+	// an entry that can never fit would just flush the whole cache
+	if m.maxBytes > 0 && size > m.maxBytes {
+		if exists {
+			m.removeEntry(oldElement, ReasonOverwritten)
+			atomic.AddUint64(&m.counters.overwrites, 1)
+		}
+
+		return
 	}
 
-	listElement, exists := lru.lookup[key]
 	if exists {
-		lru.list.MoveToFront(listElement)
-		listElement.Value = &cacheElement
+		// overwriting counts as a use, so the key keeps its place in the policy
+		m.lookup[key] = cacheElement
+		m.bytes += size - int64(oldElement.Size)
+		m.policy.Access(key)
+		m.notify(oldElement, ReasonOverwritten)
+		atomic.AddUint64(&m.counters.overwrites, 1)
+
+		// a larger value can only push the cache over its byte limit
+		for m.maxBytes > 0 && m.bytes > m.maxBytes {
+			m.deleteEntry(m.lookup[m.policy.Evict()], ReasonEvicted)
+		}
 
 		return
 	}
 
-	lru.deleteElem(lru.list.Back())
-	listElement = lru.list.PushFront(&cacheElement)
-	lru.lookup[key] = listElement
+	// make room before adding the new key, so the policy never picks it
+	for len(m.lookup) > 0 &&
+		((m.capacity > 0 && len(m.lookup)+1 > m.capacity) ||
+			(m.maxBytes > 0 && m.bytes+size > m.maxBytes)) {
 
-	return
+		m.deleteEntry(m.lookup[m.policy.Evict()], ReasonEvicted)
+	}
+
+	m.lookup[key] = cacheElement
+	m.bytes += size
+	m.policy.Add(key)
 }
 
-func (lru *LRU) Clear() {
-	lru.mutex.Lock()
-	lru.lookup = make(map[string]*list.Element, lru.capacity)
-	lru.mutex.Unlock()
+func (m *Memory) Clear() {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	for _, cacheElement := range m.lookup {
+		m.notify(cacheElement, ReasonDeleted)
+	}
+
+	m.lookup = make(map[string]*Entry, m.capacity)
+	m.policy.Clear()
+	m.bytes = 0
 }
 
-func (lru *LRU) Get(key string) (response *redis.StringCmd) {
-	lru.mutex.Lock()
-	defer lru.mutex.Unlock()
+func (m *Memory) Get(key string) (entry *Entry) {
+	m.mutex.Lock()
+	defer m.unlock()
 
-	listElement, exists := lru.lookup[key]
+	cacheElement, exists := m.lookup[key]
 	if !exists {
+		atomic.AddUint64(&m.counters.misses, 1)
 		return nil
 	}
 
-	cacheElement := listElement.Value.(*element)
-	expiryTime := cacheElement.Timestamp.Add(lru.expiry)
-
-	if time.Now().Before(expiryTime) {
-		lru.list.MoveToFront(listElement)
+	now := m.now()
+	if now.Before(cacheElement.Expires) {
+		atomic.AddUint64(&m.counters.hits, 1)
+		m.policy.Access(key)
 
-		return cacheElement.Response
+		return cacheElement
 	}
 
-	delete(lru.lookup, cacheElement.Key)
-	// We don't also delete listElement from list: we're preserving list size
+	atomic.AddUint64(&m.counters.misses, 1)
+
+	// keep expired entries around while they can still be served stale
+	if m.dead(cacheElement, now) {
+		m.removeEntry(cacheElement, ReasonExpired)
+	}
 
 	return nil
 }
 
-func (lru *LRU) deleteElem(listElement *list.Element) {
-	if listElement.Value == nil { // the initial empty elements
-		lru.list.Remove(listElement)
+func (m *Memory) GetStale(key string) (entry *Entry, stale bool) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	cacheElement, exists := m.lookup[key]
+	if !exists {
+		atomic.AddUint64(&m.counters.misses, 1)
+		return nil, false
+	}
+
+	now := m.now()
+	if m.dead(cacheElement, now) {
+		atomic.AddUint64(&m.counters.misses, 1)
+		m.removeEntry(cacheElement, ReasonExpired)
+
+		return nil, false
+	}
+
+	// stale entries count as hits, since they're served
+	atomic.AddUint64(&m.counters.hits, 1)
+	m.policy.Access(key)
+
+	return cacheElement, !now.Before(cacheElement.Expires)
+}
+
+// Peek returns the entry cached for key like Get, without counting it as a
+// use or removing it if it has expired
+func (m *Memory) Peek(key string) (entry *Entry) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	cacheElement, exists := m.lookup[key]
+	if !exists || !m.now().Before(cacheElement.Expires) {
+		return nil
+	}
+
+	return cacheElement
+}
+
+// PeekStale returns the entry cached for key like GetStale, without counting
+// it as a use or removing it if it's dead
+func (m *Memory) PeekStale(key string) (entry *Entry, stale bool) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	now := m.now()
+	cacheElement, exists := m.lookup[key]
+	if !exists || m.dead(cacheElement, now) {
+		return nil, false
+	}
+
+	return cacheElement, !now.Before(cacheElement.Expires)
+}
+
+func (m *Memory) Delete(key string) bool {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	cacheElement, exists := m.lookup[key]
+	if !exists {
+		return false
+	}
+
+	m.removeEntry(cacheElement, ReasonDeleted)
+
+	return true
+}
+
+// Len returns the number of unexpired entries in the cache
+func (m *Memory) Len() (length int) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	now := m.now()
+	for _, cacheElement := range m.lookup {
+		if now.Before(cacheElement.Expires) {
+			length++
+		}
+	}
+
+	return length
+}
+
+// Room counts expired entries that haven't been removed yet as taking up room,
+// since they're only removed to make room once the cache is full
+func (m *Memory) Room() (room int) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	room = -1
+	if m.capacity > 0 {
+		room = m.capacity - len(m.lookup)
+	}
+
+	// the bytes left, over the average entry size
+	if m.maxBytes > 0 && m.bytes > 0 {
+		if byteRoom := int((m.maxBytes - m.bytes) * int64(len(m.lookup)) / m.bytes); room == -1 || byteRoom < room {
+			room = byteRoom
+		}
+	}
+
+	return room
+}
+
+// Keys returns the keys of all unexpired entries, the last to be evicted
+// first. For the LRU policy, that's the most recently used first
+func (m *Memory) Keys() []string {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	keys := m.policy.Keys()
+	now := m.now()
+
+	unexpired := keys[:0]
+	for _, key := range keys {
+		if now.Before(m.lookup[key].Expires) {
+			unexpired = append(unexpired, key)
+		}
+	}
+
+	return unexpired
+}
+
+// Bytes returns the total size of the keys and values currently cached
+func (m *Memory) Bytes() int64 {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	return m.bytes
+}
+
+// Sweep checks up to sample randomly chosen entries, removing any that have
+// expired, and returns how many were removed
+func (m *Memory) Sweep(sample int) (reclaimed int) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	now := m.now()
+	checked := 0
+
+	// map iteration order is random, so this samples entries at random
+	for _, cacheElement := range m.lookup {
+		if checked == sample {
+			break
+		}
+		checked++
+
+		if m.dead(cacheElement, now) {
+			m.removeEntry(cacheElement, ReasonExpired)
+			reclaimed++
+		}
+	}
+
+	return reclaimed
+}
+
+// Reclaimed returns how many expired entries the background janitor removed
+func (m *Memory) Reclaimed() uint64 {
+	if m.janitor == nil {
+		return 0
+	}
+
+	return m.janitor.Reclaimed()
+}
+
+// Stats returns a snapshot of the cache's counters. Peek, Keys and Len don't
+// count as hits or misses
+func (m *Memory) Stats() Stats {
+	return m.counters.snapshot()
+}
+
+func (m *Memory) ResetStats() {
+	m.counters.reset()
+}
+
+func (m *Memory) WriteSnapshot(w io.Writer) error {
+	return writeSnapshot(w, m.snapshotEntries())
+}
+
+func (m *Memory) ReadSnapshot(r io.Reader) error {
+	return readSnapshot(r, m.restore)
+}
+
+// snapshotEntries returns every entry that isn't dead, the first to be evicted
+// first. Entries are never modified, so they can be written out after the
+// mutex is released
+func (m *Memory) snapshotEntries() []*Entry {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	keys := m.policy.Keys()
+	now := m.now()
+
+	entries := make([]*Entry, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		if cacheElement := m.lookup[keys[i]]; !m.dead(cacheElement, now) {
+			entries = append(entries, cacheElement)
+		}
+	}
+
+	return entries
+}
+
+// restore caches an entry from a snapshot, unless it's dead. Entries keep
+// their original expiry, cut short if this cache's expiry is shorter
+func (m *Memory) restore(cacheElement *Entry) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	if expires := cacheElement.Timestamp.Add(m.expiry); expires.Before(cacheElement.Expires) {
+		cacheElement.Expires = expires
+	}
+
+	if m.dead(cacheElement, m.now()) {
 		return
 	}
 
-	cacheElement := listElement.Value.(*element)
+	cacheElement.Tier = TierMemory
+	m.setEntry(cacheElement)
+}
+
+// Close stops the background janitor, if there is one
+func (m *Memory) Close() {
+	if m.janitor != nil {
+		m.janitor.Stop()
+	}
+}
 
-	delete(lru.lookup, cacheElement.Key)
-	lru.list.Remove(listElement)
+// addJitter shortens a new entry's lifetime by a random fraction of up to
+// the cache's jitter, so entries cached together don't all expire together
+func (m *Memory) addJitter(cacheElement *Entry) {
+	if m.jitter == 0 {
+		return
+	}
+
+	lifetime := cacheElement.Expires.Sub(cacheElement.Timestamp)
+	cut := time.Duration(rand.Float64() * m.jitter * float64(lifetime))
+	cacheElement.Expires = cacheElement.Expires.Add(-cut)
+}
+
+// compress compresses a new entry's value, if it's over the compression
+// threshold and compressing makes it smaller
+func (m *Memory) compress(cacheElement *Entry) {
+	if m.codec == nil || len(cacheElement.Value) <= m.compressMin {
+		return
+	}
+
+	encoded, err := m.codec.Encode(cacheElement.Value)
+	if err != nil || len(encoded) >= len(cacheElement.Value) {
+		return
+	}
+
+	cacheElement.Value = encoded
+	cacheElement.Encoding = m.codecName
+	cacheElement.Size = len(cacheElement.Key) + len(encoded)
+}
+
+// etagFor returns a strong ETag for a stored value. A stored value decodes to
+// one value only, so it also identifies the decoded value
+func etagFor(value []byte) string {
+	hash := sha1.Sum(value)
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// transient returns whether key is only kept in memory, see TransientPrefix
+func transient(key string) bool {
+	return strings.HasPrefix(key, TransientPrefix)
+}
+
+// dead returns whether an entry has expired, and can't be served stale either
+func (m *Memory) dead(cacheElement *Entry, now time.Time) bool {
+	return !now.Before(cacheElement.Expires.Add(m.staleWindow))
+}
+
+// removeEntry removes an entry the policy is still tracking
+func (m *Memory) removeEntry(cacheElement *Entry, reason RemovalReason) {
+	m.policy.Remove(cacheElement.Key)
+	m.deleteEntry(cacheElement, reason)
+}
+
+// deleteEntry removes an entry the policy has already forgotten, like one it
+// just evicted
+func (m *Memory) deleteEntry(cacheElement *Entry, reason RemovalReason) {
+	delete(m.lookup, cacheElement.Key)
+	m.bytes -= int64(cacheElement.Size)
+	m.counters.removed(reason)
+	m.notify(cacheElement, reason)
+}
+
+// notify queues the removal hooks for an entry, to run once the mutex is
+// released
+func (m *Memory) notify(cacheElement *Entry, reason RemovalReason) {
+	if len(m.hooks) > 0 {
+		m.removed = append(m.removed, removal{entry: cacheElement, reason: reason})
+	}
+}
+
+// unlock releases the mutex, then runs the removal hooks for every entry
+// removed while it was held, so hooks can safely use the cache themselves
+func (m *Memory) unlock() {
+	removed := m.removed
+	m.removed = nil
+	m.mutex.Unlock()
+
+	for _, r := range removed {
+		for _, hook := range m.hooks {
+			hook(r.entry, r.reason)
+		}
+	}
 }
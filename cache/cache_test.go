@@ -1,10 +1,11 @@
 package cache
 
 import (
+	"bytes"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
-
-	"github.com/go-redis/redis"
 )
 
 func TestCacheCreation(t *testing.T) {
@@ -14,29 +15,41 @@ func TestCacheCreation(t *testing.T) {
 	}
 }
 
+func TestOptionalInterfaces(t *testing.T) {
+	for _, c := range []Cache{&Memory{}, &Sharded{}, &Tiered{}} {
+		_, snapshotter := c.(Snapshotter)
+		_, reporter := c.(StatsReporter)
+		_, bounded := c.(Bounded)
+
+		if !snapshotter || !reporter || !bounded {
+			t.Errorf("%T missing an optional interface", c)
+		}
+	}
+}
+
 func TestMaxCapacity(t *testing.T) {
 	lru, err := NewLRU(1000, 5)
 	if err != nil {
 		panic(err)
 	}
 
-	a := redis.StringCmd{}
-	b := redis.StringCmd{}
-	c := redis.StringCmd{}
-	d := redis.StringCmd{}
-	e := redis.StringCmd{}
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+	e := []byte("e")
 
-	lru.Set("a", &a)
-	lru.Set("b", &b)
-	lru.Set("c", &c)
-	lru.Set("d", &d)
-	lru.Set("e", &e)
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+	lru.Set("d", d)
+	lru.Set("e", e)
 
-	if lru.Get("a") != &a ||
-		lru.Get("b") != &b ||
-		lru.Get("c") != &c ||
-		lru.Get("d") != &d ||
-		lru.Get("e") != &e {
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c", c) ||
+		!cached(lru, "d", d) ||
+		!cached(lru, "e", e) {
 
 		t.Fail()
 	}
@@ -48,26 +61,26 @@ func TestOverflowCapacity(t *testing.T) {
 		panic(err)
 	}
 
-	a := redis.StringCmd{}
-	b := redis.StringCmd{}
-	c := redis.StringCmd{}
-	d := redis.StringCmd{}
-	e := redis.StringCmd{}
-	f := redis.StringCmd{}
-
-	lru.Set("a", &a)
-	lru.Set("b", &b)
-	lru.Set("c", &c)
-	lru.Set("d", &d)
-	lru.Set("e", &e)
-	lru.Set("f", &f)
-
-	if lru.Get("a") != nil ||
-		lru.Get("b") != &b ||
-		lru.Get("c") != &c ||
-		lru.Get("d") != &d ||
-		lru.Get("e") != &e ||
-		lru.Get("f") != &f {
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+	e := []byte("e")
+	f := []byte("f")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+	lru.Set("d", d)
+	lru.Set("e", e)
+	lru.Set("f", f)
+
+	if !cached(lru, "a", nil) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c", c) ||
+		!cached(lru, "d", d) ||
+		!cached(lru, "e", e) ||
+		!cached(lru, "f", f) {
 
 		t.Fail()
 	}
@@ -79,31 +92,31 @@ func TestCacheCycling(t *testing.T) {
 		panic(err)
 	}
 
-	a := redis.StringCmd{}
-	b := redis.StringCmd{}
-	c := redis.StringCmd{}
-	d := redis.StringCmd{}
-	e := redis.StringCmd{}
-	f := redis.StringCmd{}
-
-	lru.Set("a", &a)
-	lru.Set("b", &b)
-	lru.Set("c", &c)
-	lru.Set("d", &d)
-	lru.Set("e", &e)
-	lru.Set("f", &f)
-
-	lru.Set("a", &a)
-
-	if lru.Get("a") != &a ||
-		lru.Get("b") != nil ||
-		lru.Get("b") != nil ||
-		lru.Get("c") != nil ||
-		lru.Get("d") != nil ||
-		lru.Get("e") != &e ||
-		lru.Get("e") != &e ||
-		lru.Get("e") != &e ||
-		lru.Get("f") != &f {
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+	e := []byte("e")
+	f := []byte("f")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+	lru.Set("d", d)
+	lru.Set("e", e)
+	lru.Set("f", f)
+
+	lru.Set("a", a)
+
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", nil) ||
+		!cached(lru, "b", nil) ||
+		!cached(lru, "c", nil) ||
+		!cached(lru, "d", nil) ||
+		!cached(lru, "e", e) ||
+		!cached(lru, "e", e) ||
+		!cached(lru, "e", e) ||
+		!cached(lru, "f", f) {
 
 		t.Fail()
 	}
@@ -115,24 +128,24 @@ func TestReassignment(t *testing.T) {
 		panic(err)
 	}
 
-	a := redis.StringCmd{}
-	b := redis.StringCmd{}
-	c := redis.StringCmd{}
-	d := redis.StringCmd{}
-	e := redis.StringCmd{}
-
-	lru.Set("a", &a)
-	lru.Set("b", &b)
-	lru.Set("c->a", &c)
-	lru.Set("d", &d)
-	lru.Set("e", &e)
-	lru.Set("c->a", &a)
-
-	if lru.Get("a") != &a ||
-		lru.Get("b") != &b ||
-		lru.Get("c->a") != &a ||
-		lru.Get("d") != &d ||
-		lru.Get("e") != &e {
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+	e := []byte("e")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c->a", c)
+	lru.Set("d", d)
+	lru.Set("e", e)
+	lru.Set("c->a", a)
+
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c->a", a) ||
+		!cached(lru, "d", d) ||
+		!cached(lru, "e", e) {
 
 		t.Fail()
 	}
@@ -144,61 +157,566 @@ func TestCacheTimeout(t *testing.T) {
 		panic(err)
 	}
 
-	a := redis.StringCmd{}
-	b := redis.StringCmd{}
-	c := redis.StringCmd{}
-	d := redis.StringCmd{}
-	e := redis.StringCmd{}
-	f := redis.StringCmd{}
-
-	lru.Set("a", &a)
-	time.Sleep(9 * time.Millisecond)
-	lru.Set("b", &b)
-	time.Sleep(9 * time.Millisecond)
-	lru.Set("c", &c)
-	time.Sleep(9 * time.Millisecond)
-	lru.Set("d", &d)
-	time.Sleep(9 * time.Millisecond)
-	lru.Set("e", &e)
-	time.Sleep(9 * time.Millisecond)
-	lru.Set("f", &f)
-	time.Sleep(9 * time.Millisecond)
-
-	if lru.Get("a") != nil {
+	// a fake clock, so slow test machines can't expire entries early
+	clock := newFakeClock()
+	lru.now = clock.Now
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+	e := []byte("e")
+	f := []byte("f")
+
+	lru.Set("a", a)
+	clock.Advance(9 * time.Millisecond)
+	lru.Set("b", b)
+	clock.Advance(9 * time.Millisecond)
+	lru.Set("c", c)
+	clock.Advance(9 * time.Millisecond)
+	lru.Set("d", d)
+	clock.Advance(9 * time.Millisecond)
+	lru.Set("e", e)
+	clock.Advance(9 * time.Millisecond)
+	lru.Set("f", f)
+	clock.Advance(9 * time.Millisecond)
+
+	if !cached(lru, "a", nil) {
 		t.Fail()
 	}
 
 	// b should have expired, c shouldn't have
-	time.Sleep(50 * time.Millisecond)
-	if lru.Get("b") != nil ||
-		lru.Get("c") != &c {
+	clock.Advance(59 * time.Millisecond)
+	if !cached(lru, "b", nil) ||
+		!cached(lru, "c", c) {
 
 		t.Fail()
 	}
 
 	// c should have expired
-	time.Sleep(10 * time.Millisecond)
-	if lru.Get("c") != nil {
+	clock.Advance(10 * time.Millisecond)
+	if !cached(lru, "c", nil) {
 
 		t.Fail()
 	}
 
 	// d should have expired
-	time.Sleep(10 * time.Millisecond)
-	if lru.Get("d") != nil {
+	clock.Advance(10 * time.Millisecond)
+	if !cached(lru, "d", nil) {
 
 		t.Fail()
 	}
 
 	// all should have expired
+	clock.Advance(100 * time.Millisecond)
+	if !cached(lru, "a", nil) ||
+		!cached(lru, "b", nil) ||
+		!cached(lru, "c", nil) ||
+		!cached(lru, "d", nil) ||
+		!cached(lru, "e", nil) ||
+		!cached(lru, "f", nil) {
+
+		t.Fail()
+	}
+}
+
+func TestEntryMetadata(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	before := time.Now()
+	lru.Set("key", []byte("value"))
+
+	entry := lru.Get("key")
+	if entry == nil {
+		t.Fatal("Entry not cached")
+	}
+
+	if entry.Key != "key" ||
+		string(entry.Value) != "value" ||
+		entry.Size != len("key")+len("value") ||
+		entry.Timestamp.Before(before) {
+
+		t.Fail()
+	}
+}
+
+func TestSetFetchedIf(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	absent := func(current *Entry) bool {
+		return current == nil
+	}
+
+	if _, stored := lru.SetFetchedIf("a", []byte("old"), Fetched{}, absent); !stored {
+		t.Error("Entry not cached while absent")
+	}
+
+	entry, stored := lru.SetFetchedIf("a", []byte("new"), Fetched{}, absent)
+	if stored || entry == nil || string(entry.Value) != "new" || !cached(lru, "a", []byte("old")) {
+		t.Error("Entry replaced when it shouldn't have been")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	lru, err := NewLRU(1000, 3)
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+
+	if !lru.Delete("b") || lru.Delete("b") || lru.Len() != 2 {
+		t.Fail()
+	}
+
+	// the deleted slot should be reused, rather than evicting a
+	lru.Set("d", d)
+
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", nil) ||
+		!cached(lru, "c", c) ||
+		!cached(lru, "d", d) ||
+		lru.Len() != 3 {
+
+		t.Fail()
+	}
+}
+
+// utility functions
+func cached(c Cache, key string, value []byte) bool {
+	entry := c.Get(key)
+	if value == nil {
+		return entry == nil
+	}
+
+	return entry != nil && bytes.Equal(entry.Value, value)
+}
+
+// fakeClock is a clock that only moves when it's advanced
+type fakeClock struct {
+	mutex *sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{mutex: &sync.Mutex{}, now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestMaxBytes(t *testing.T) {
+	// each key/value pair below is 2 bytes, so only 3 fit
+	lru, err := NewLRU(1000, 0, WithMaxBytes(6))
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+	d := []byte("d")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+	lru.Set("d", d)
+
+	if !cached(lru, "a", nil) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c", c) ||
+		!cached(lru, "d", d) ||
+		lru.Bytes() != 6 {
+
+		t.Fail()
+	}
+
+	// a larger value should evict as many entries as it needs room for
+	lru.Set("e", []byte("eee"))
+
+	if !cached(lru, "b", nil) ||
+		!cached(lru, "c", nil) ||
+		!cached(lru, "d", d) ||
+		!cached(lru, "e", []byte("eee")) ||
+		lru.Bytes() != 6 {
+
+		t.Fail()
+	}
+}
+
+func TestMaxBytesWithCapacity(t *testing.T) {
+	lru, err := NewLRU(1000, 2, WithMaxBytes(100))
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	lru.Set("b", []byte("b"))
+	lru.Set("c", []byte("c"))
+
+	if !cached(lru, "a", nil) || lru.Len() != 2 || lru.Bytes() != 4 {
+		t.Fail()
+	}
+
+	lru.Set("d", make([]byte, 98))
+
+	if !cached(lru, "b", nil) ||
+		!cached(lru, "c", nil) ||
+		lru.Len() != 1 ||
+		lru.Bytes() != 99 {
+
+		t.Fail()
+	}
+}
+
+func TestOversizedEntry(t *testing.T) {
+	lru, err := NewLRU(1000, 0, WithMaxBytes(10))
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	lru.Set("a", a)
+	lru.Set("b", make([]byte, 10))
+
+	// the oversized entry isn't cached, and doesn't flush the rest of the cache
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", nil) ||
+		lru.Bytes() != 2 {
+
+		t.Fail()
+	}
+
+	// overwriting a key with an oversized value drops the stale value
+	lru.Set("a", make([]byte, 10))
+
+	if !cached(lru, "a", nil) || lru.Bytes() != 0 {
+		t.Fail()
+	}
+}
+
+func TestBytesTracking(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("aaaa"))
+	lru.Set("b", []byte("b"))
+	if lru.Bytes() != 7 {
+		t.Error("Wrong size after set", lru.Bytes())
+	}
+
+	lru.Set("a", []byte("a"))
+	if lru.Bytes() != 4 {
+		t.Error("Wrong size after overwrite", lru.Bytes())
+	}
+
+	lru.Delete("b")
+	if lru.Bytes() != 2 {
+		t.Error("Wrong size after delete", lru.Bytes())
+	}
+}
+
+func TestUnboundedCreation(t *testing.T) {
+	_, err := NewLRU(1000, 0)
+	if err != ErrUnbounded {
+		t.Error("Unbounded cache accepted")
+	}
+
+	_, err = NewLRU(1000, 5, WithMaxBytes(-1))
+	if err != ErrNegativeValues {
+		t.Error("Negative byte limit accepted")
+	}
+}
+
+func TestSourceTTL(t *testing.T) {
+	lru, err := NewLRU(200, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+
+	lru.SetWithTTL("a", a, 50*time.Millisecond)
+	lru.SetWithTTL("b", b, time.Hour)
+	lru.SetWithTTL("c", c, 0)
+
+	if lru.Get("a").TTL != 50*time.Millisecond {
+		t.Error("Source TTL not recorded")
+	}
+
+	// a should have expired with its source TTL, b and c shouldn't have
 	time.Sleep(100 * time.Millisecond)
-	if lru.Get("a") != nil ||
-		lru.Get("b") != nil ||
-		lru.Get("c") != nil ||
-		lru.Get("d") != nil ||
-		lru.Get("e") != nil ||
-		lru.Get("f") != nil {
+	if !cached(lru, "a", nil) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c", c) {
 
 		t.Fail()
 	}
+
+	// b and c should have expired with the cache expiry
+	time.Sleep(150 * time.Millisecond)
+	if !cached(lru, "b", nil) ||
+		!cached(lru, "c", nil) {
+
+		t.Fail()
+	}
+}
+
+func TestClear(t *testing.T) {
+	lru, err := NewLRU(1000, 3)
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Clear()
+	checkConsistency(t, lru)
+
+	if lru.Len() != 0 || len(lru.lookup) != 0 || lru.Bytes() != 0 {
+		t.Fail()
+	}
+
+	// the full capacity is available again, without stale evictions
+	lru.Set("a", a)
+	lru.Set("b", b)
+	lru.Set("c", c)
+	checkConsistency(t, lru)
+
+	if !cached(lru, "a", a) ||
+		!cached(lru, "b", b) ||
+		!cached(lru, "c", c) {
+
+		t.Fail()
+	}
+}
+
+func TestDeleteConsistency(t *testing.T) {
+	lru, err := NewLRU(1000, 3)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	lru.Set("b", []byte("b"))
+	lru.Set("c", []byte("c"))
+
+	lru.Delete("a")
+	lru.Delete("b")
+	checkConsistency(t, lru)
+
+	lru.Delete("missing")
+	lru.Set("d", []byte("d"))
+	lru.Set("b", []byte("b"))
+	checkConsistency(t, lru)
+
+	if len(lru.lookup) != 3 || lru.Len() != 3 {
+		t.Fail()
+	}
+}
+
+func TestPeek(t *testing.T) {
+	lru, err := NewLRU(1000, 2)
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	lru.Set("a", a)
+	lru.Set("b", []byte("b"))
+
+	// peeking doesn't make a more recently used, so it's still evicted first
+	entry := lru.Peek("a")
+	if entry == nil || !bytes.Equal(entry.Value, a) {
+		t.Fail()
+	}
+
+	lru.Set("c", []byte("c"))
+	if lru.Peek("a") != nil || lru.Peek("b") == nil {
+		t.Fail()
+	}
+
+	// peeking an expired entry misses, but leaves it to be expired elsewhere
+	lru.SetWithTTL("d", []byte("d"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if lru.Peek("d") != nil || len(lru.lookup) != 2 {
+		t.Fail()
+	}
+	checkConsistency(t, lru)
+}
+
+func TestLenCountsLiveEntries(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	lru.SetWithTTL("b", []byte("b"), time.Millisecond)
+	lru.Set("c", []byte("c"))
+
+	time.Sleep(5 * time.Millisecond)
+
+	if lru.Len() != 2 {
+		t.Error("Expired entry counted", lru.Len())
+	}
+}
+
+func TestRoom(t *testing.T) {
+	lru, err := NewLRU(1000, 2)
+	if err != nil {
+		panic(err)
+	}
+
+	for i, expected := range []int{2, 1, 0, 0} {
+		if lru.Room() != expected {
+			t.Error("Unexpected room", i, lru.Room())
+		}
+
+		lru.Set(fmt.Sprint(i), []byte("a"))
+	}
+
+	// room under a byte limit is estimated from the entries so far
+	bounded, err := NewLRU(1000, 0, WithMaxBytes(100))
+	if err != nil {
+		panic(err)
+	}
+
+	if bounded.Room() != -1 {
+		t.Error("Room estimated from nothing", bounded.Room())
+	}
+
+	bounded.Set("a", make([]byte, 19))
+	if bounded.Room() != 4 {
+		t.Error("Unexpected byte room", bounded.Room())
+	}
+}
+
+func TestKeys(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	lru.Set("b", []byte("b"))
+	lru.SetWithTTL("c", []byte("c"), time.Millisecond)
+	lru.Set("d", []byte("d"))
+	lru.Get("a")
+
+	time.Sleep(5 * time.Millisecond)
+
+	keys := lru.Keys()
+	expected := []string{"a", "d", "b"}
+
+	if len(keys) != len(expected) {
+		t.Fatal("Wrong keys", keys)
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Fatal("Wrong key order", keys)
+		}
+	}
+}
+
+// checkConsistency checks that the lookup map and eviction policy hold the
+// same keys, and that the tracked size matches the cached entries
+func checkConsistency(t *testing.T, m *Memory) {
+	keys := m.policy.Keys()
+	if len(m.lookup) != len(keys) {
+		t.Error("Map and policy sizes differ", len(m.lookup), len(keys))
+	}
+
+	var bytes int64
+	for _, key := range keys {
+		cacheElement, exists := m.lookup[key]
+		if !exists {
+			t.Error("Policy key missing from map", key)
+			continue
+		}
+
+		bytes += int64(cacheElement.Size)
+	}
+
+	if bytes != m.bytes {
+		t.Error("Tracked bytes differ from cached entries", bytes, m.bytes)
+	}
+}
+
+func TestStaleWindow(t *testing.T) {
+	lru, err := NewLRU(20, 5, WithStaleWindow(50*time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	lru.Set("a", a)
+
+	entry, stale := lru.GetStale("a")
+	if entry == nil || stale {
+		t.Error("Fresh entry served as stale")
+	}
+
+	// expired, but within the stale window
+	time.Sleep(30 * time.Millisecond)
+
+	entry, stale = lru.GetStale("a")
+	if entry == nil || !bytes.Equal(entry.Value, a) || !stale {
+		t.Error("Stale entry not served as stale")
+	}
+
+	if lru.Get("a") != nil || lru.Len() != 0 {
+		t.Error("Stale entry served as fresh")
+	}
+
+	// Get and sweeps leave stale entries in the cache
+	lru.Sweep(5)
+	if entry, _ = lru.GetStale("a"); entry == nil {
+		t.Error("Stale entry removed")
+	}
+
+	// past the stale window
+	time.Sleep(50 * time.Millisecond)
+
+	if entry, _ = lru.GetStale("a"); entry != nil {
+		t.Error("Entry served past the stale window")
+	}
+	checkConsistency(t, lru)
+
+	if len(lru.lookup) != 0 {
+		t.Error("Dead entry not removed")
+	}
 }
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrUnknownCodec = errors.New("unknown cache compression codec")
+
+// Compression codec names, for WithCompression and Entry.Encoding
+const (
+	CodecGzip   = "gzip"
+	CodecSnappy = "snappy"
+	CodecZstd   = "zstd"
+)
+
+// codec compresses and decompresses values
+type codec interface {
+	Encode(value []byte) ([]byte, error)
+	Decode(encoded []byte) ([]byte, error)
+}
+
+func newCodec(name string) (codec, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case CodecGzip:
+		return gzipCodec{}, nil
+	case CodecSnappy:
+		return snappyCodec{}, nil
+	case CodecZstd:
+		return zstdCodec{}, nil
+	}
+
+	return nil, ErrUnknownCodec
+}
+
+// Decoded returns the entry's original value, decompressing it if it was
+// stored compressed
+func (e *Entry) Decoded() ([]byte, error) {
+	if e.Encoding == "" {
+		return e.Value, nil
+	}
+
+	c, err := newCodec(e.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Decode(e.Value)
+}
+
+// gzipWriters reuses gzip writers, which allocate a lot to set up
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(value []byte) ([]byte, error) {
+	var encoded bytes.Buffer
+
+	writer := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(writer)
+	writer.Reset(&encoded)
+
+	_, err := writer.Write(value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
+
+func (gzipCodec) Decode(encoded []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(value []byte) ([]byte, error) {
+	return snappy.Encode(nil, value), nil
+}
+
+func (snappyCodec) Decode(encoded []byte) ([]byte, error) {
+	return snappy.Decode(nil, encoded)
+}
+
+// zstdEncoder and zstdDecoder are shared, since they're safe to use
+// concurrently through EncodeAll and DecodeAll, and costly to set up. Frames
+// are written with checksums, and checked when they're read
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(value []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(value, nil), nil
+}
+
+func (zstdCodec) Decode(encoded []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(encoded, nil)
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var compressible = bytes.Repeat([]byte(`{"key": "value"}`), 64)
+
+func TestCompression(t *testing.T) {
+	for _, codec := range []string{CodecGzip, CodecSnappy, CodecZstd} {
+		lru, err := NewLRU(1000, 5, WithCompression(codec, 100))
+		if err != nil {
+			panic(err)
+		}
+
+		lru.Set("large", compressible)
+		lru.Set("small", []byte("small"))
+
+		entry := lru.Get("large")
+		if entry.Encoding != codec || len(entry.Value) >= len(compressible) {
+			t.Error("Large value not compressed", codec)
+		}
+
+		value, err := entry.Decoded()
+		if err != nil || !bytes.Equal(value, compressible) {
+			t.Error("Large value not decompressed", codec, err)
+		}
+
+		entry = lru.Get("small")
+		if entry.Encoding != "" || !bytes.Equal(entry.Value, []byte("small")) {
+			t.Error("Small value compressed", codec)
+		}
+
+		// byte accounting counts the compressed size
+		if lru.Bytes() != int64(len("large")+len(lru.Get("large").Value)+len("small")+len("small")) {
+			t.Error("Uncompressed size counted", codec)
+		}
+		checkConsistency(t, lru)
+	}
+}
+
+func TestCompressionIncompressible(t *testing.T) {
+	lru, err := NewLRU(1000, 5, WithCompression(CodecSnappy, 0))
+	if err != nil {
+		panic(err)
+	}
+
+	// values that don't shrink are kept as they are
+	lru.Set("a", []byte("abcdefgh"))
+	if entry := lru.Get("a"); entry.Encoding != "" {
+		t.Error("Incompressible value compressed")
+	}
+}
+
+func TestCompressionOptions(t *testing.T) {
+	if _, err := NewLRU(1000, 5, WithCompression("lz4", 100)); err != ErrUnknownCodec {
+		t.Error("Unknown codec accepted")
+	}
+
+	if _, err := NewLRU(1000, 5, WithCompression(CodecGzip, -1)); err != ErrNegativeValues {
+		t.Error("Negative threshold accepted")
+	}
+}
+
+func TestZstd(t *testing.T) {
+	large := make([]byte, 300<<10)
+	for i := range large {
+		large[i] = byte(i * i >> 7)
+	}
+
+	// empty values, and values over one block
+	for _, value := range [][]byte{nil, []byte("a"), large} {
+		encoded, err := zstdCodec{}.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := zstdCodec{}.Decode(encoded)
+		if err != nil || !bytes.Equal(decoded, value) {
+			t.Error("Value not decoded", len(value), err)
+		}
+	}
+
+	zstdEncoded, _ := zstdCodec{}.Encode(large)
+	gzipEncoded, _ := gzipCodec{}.Encode(large)
+	if len(zstdEncoded) >= len(gzipEncoded) {
+		t.Error("zstd compressed worse than gzip", len(zstdEncoded), len(gzipEncoded))
+	}
+
+	// frames written by the zstd command, with checksums and repeat offsets
+	frames := map[string][]byte{
+		strings.Repeat("y", 100): {
+			0x28, 0xb5, 0x2f, 0xfd, 0x24, 0x64, 0x45, 0x00, 0x00, 0x10, 0x79, 0x79,
+			0x01, 0x00, 0x3f, 0x01, 0x2c, 0xbf, 0xa0, 0xb8, 0xf4,
+		},
+		strings.Repeat("abc", 9): {
+			0x28, 0xb5, 0x2f, 0xfd, 0x24, 0x1b, 0x4d, 0x00, 0x00, 0x18, 0x61, 0x62,
+			0x63, 0x01, 0x00, 0x82, 0x6e, 0x08, 0xe2, 0xaa, 0x30, 0x8e,
+		},
+	}
+
+	for value, frame := range frames {
+		decoded, err := zstdCodec{}.Decode(frame)
+		if err != nil || string(decoded) != value {
+			t.Error("Frame not decoded", value, err)
+		}
+
+		if _, err := (zstdCodec{}).Decode(frame[:len(frame)-5]); err == nil {
+			t.Error("Truncated frame decoded", value)
+		}
+
+		corrupted := append([]byte{}, frame...)
+		corrupted[len(corrupted)-1] ^= 1
+		if _, err := (zstdCodec{}).Decode(corrupted); err == nil {
+			t.Error("Frame with a bad checksum decoded", value)
+		}
+	}
+}
+
+func TestCompressedHooksAndTiers(t *testing.T) {
+	var removed []byte
+	hook := func(key string, value []byte, reason RemovalReason) {
+		removed = value
+	}
+
+	lru, err := NewLRU(1000, 5, WithCompression(CodecGzip, 100), WithRemovalHook(hook))
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", compressible)
+	lru.Delete("a")
+	if !bytes.Equal(removed, compressible) {
+		t.Error("Hook given a compressed value")
+	}
+
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 1, 1, disk, WithCompression(CodecGzip, 100))
+	if err != nil {
+		panic(err)
+	}
+	defer tiered.Close()
+
+	tiered.Set("a", compressible)
+	tiered.Set("b", []byte("b"))
+	tiered.flush()
+
+	// demoted entries stay compressed on disk, and are decompressed to promote
+	if entry := disk.Get("a"); entry == nil || entry.Encoding != CodecGzip {
+		t.Error("Demoted entry not kept compressed")
+	}
+
+	entry := tiered.Get("a")
+	if value, err := entry.Decoded(); err != nil || !bytes.Equal(value, compressible) {
+		t.Error("Demoted entry not decompressed")
+	}
+
+	if entry = tiered.Get("a"); entry.Tier != TierMemory || entry.Encoding != CodecGzip {
+		t.Error("Promoted entry not recompressed")
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	lru, err := NewLRU(1000, 5, WithCompression(CodecSnappy, 100))
+	if err != nil {
+		panic(err)
+	}
+
+	lru.SetWithTTL("a", compressible, time.Hour)
+
+	var snapshot bytes.Buffer
+	err = lru.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots restore into caches that don't compress, or compress differently
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := restored.Get("a")
+	if value, err := entry.Decoded(); err != nil || !bytes.Equal(value, compressible) {
+		t.Error("Compressed entry not restored")
+	}
+
+	if entry.ETag == "" || entry.ETag != lru.Get("a").ETag {
+		t.Error("Restored entry's ETag changed")
+	}
+}
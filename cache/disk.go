@@ -0,0 +1,385 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Disk is a cache tier on local disk, holding each entry in its own file, and
+// evicting least recently used entries to stay within a byte limit. Files are
+// written to a temporary file and renamed into place, so a crash never leaves
+// a torn entry behind, and NewDisk picks up entries left by a previous run.
+// Disk's index is locked around file operations, so disk reads and writes are
+// serialized
+type Disk struct {
+	counters counters // first, for 64 bit alignment of atomic operations
+
+	dir      string
+	maxBytes int64
+	bytes    int64
+	expiry   time.Duration
+	policy   policy
+	index    map[string]*diskEntry
+	mutex    *sync.Mutex
+	now      func() time.Time // the clock entries are timed by, replaced in tests
+}
+
+// diskEntry is what Disk keeps in memory about each entry on disk
+type diskEntry struct {
+	file    string
+	size    int64
+	expires time.Time
+}
+
+// Entry files are a header, followed by the entry as it's written in snapshots:
+//
+//	magic   "SCDISK"
+//	version uint16, the same as the snapshot format version
+const diskMagic = "SCDISK"
+const diskVersion = snapshotVersion
+
+// diskTempPrefix marks files that were still being written, and are removed
+// on startup
+const diskTempPrefix = ".tmp-"
+
+// NewDisk creates a disk tier in dir, holding entries for at most expiry ms
+// each, and at most maxBytes of entry files in total. Entries already in dir
+// are loaded, least recently written first, and any that are expired, corrupt
+// or over the byte limit are removed
+func NewDisk(dir string, expiry int, maxBytes int64) (d *Disk, err error) {
+	if expiry < 0 || maxBytes < 0 {
+		return nil, ErrNegativeValues
+	}
+
+	if maxBytes == 0 {
+		return nil, ErrUnbounded
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		expiry:   time.Duration(expiry) * time.Millisecond,
+		policy:   newLRUPolicy(),
+		index:    make(map[string]*diskEntry),
+		mutex:    &sync.Mutex{},
+		now:      time.Now,
+	}
+
+	return d, d.load()
+}
+
+// Get returns the entry stored for key, or nil if there is none or it has
+// expired. Entries are read from disk on every Get
+func (d *Disk) Get(key string) *Entry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	indexed, exists := d.index[key]
+	if !exists {
+		atomic.AddUint64(&d.counters.misses, 1)
+		return nil
+	}
+
+	if !d.now().Before(indexed.expires) {
+		atomic.AddUint64(&d.counters.misses, 1)
+		d.remove(key, ReasonExpired)
+		return nil
+	}
+
+	entry, err := readDiskFile(indexed.file)
+	if err != nil || entry.Key != key {
+		// the file was corrupted or removed behind our back
+		atomic.AddUint64(&d.counters.misses, 1)
+		d.remove(key, ReasonDeleted)
+		return nil
+	}
+
+	atomic.AddUint64(&d.counters.hits, 1)
+	d.policy.Access(key)
+
+	entry.Tier = TierDisk
+	return entry
+}
+
+// Put stores entry for the disk tier's expiry, or until its source TTL runs
+// out if that's sooner. Entries that can never fit, and transient entries,
+// aren't stored
+func (d *Disk) Put(entry *Entry) error {
+	return d.putIf(entry, nil)
+}
+
+// putIf is like Put, but first calls valid with the disk tier locked, and
+// only stores entry if it returns true. valid mustn't use the disk tier
+func (d *Disk) putIf(entry *Entry, valid func() bool) error {
+	now := d.now()
+
+	stored := *entry
+	stored.Expires = now.Add(d.expiry)
+	if entry.TTL > 0 && entry.Timestamp.Add(entry.TTL).Before(stored.Expires) {
+		stored.Expires = entry.Timestamp.Add(entry.TTL)
+	}
+
+	if transient(entry.Key) {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if valid != nil && !valid() {
+		return nil
+	}
+
+	atomic.AddUint64(&d.counters.sets, 1)
+
+	if _, exists := d.index[entry.Key]; exists {
+		atomic.AddUint64(&d.counters.overwrites, 1)
+		d.remove(entry.Key, ReasonOverwritten)
+	}
+
+	if !now.Before(stored.Expires) {
+		return nil
+	}
+
+	file := d.path(entry.Key)
+	size, err := writeDiskFile(file, &stored)
+	if err != nil {
+		return err
+	}
+
+	if size > d.maxBytes {
+		return os.Remove(file)
+	}
+
+	d.add(entry.Key, &diskEntry{file: file, size: size, expires: stored.Expires})
+
+	return nil
+}
+
+// Delete removes key from the disk tier, returning whether it was stored
+func (d *Disk) Delete(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, exists := d.index[key]; !exists {
+		return false
+	}
+
+	d.remove(key, ReasonDeleted)
+
+	return true
+}
+
+// Len returns the number of unexpired entries on disk
+func (d *Disk) Len() (length int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	for _, indexed := range d.index {
+		if now.Before(indexed.expires) {
+			length++
+		}
+	}
+
+	return length
+}
+
+// Bytes returns the total size of the entry files on disk
+func (d *Disk) Bytes() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.bytes
+}
+
+func (d *Disk) Clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for key := range d.index {
+		d.remove(key, ReasonDeleted)
+	}
+}
+
+func (d *Disk) Stats() Stats {
+	return d.counters.snapshot()
+}
+
+func (d *Disk) ResetStats() {
+	d.counters.reset()
+}
+
+// add indexes an entry file, evicting entries until it fits
+func (d *Disk) add(key string, indexed *diskEntry) {
+	for len(d.index) > 0 && d.bytes+indexed.size > d.maxBytes {
+		d.forget(d.policy.Evict(), ReasonEvicted)
+	}
+
+	d.index[key] = indexed
+	d.bytes += indexed.size
+	d.policy.Add(key)
+}
+
+// remove deletes the file of an entry the policy is still tracking
+func (d *Disk) remove(key string, reason RemovalReason) {
+	d.policy.Remove(key)
+	d.forget(key, reason)
+}
+
+// forget deletes the file of an entry the policy has already forgotten, like
+// one it just evicted
+func (d *Disk) forget(key string, reason RemovalReason) {
+	indexed := d.index[key]
+
+	os.Remove(indexed.file)
+	delete(d.index, key)
+	d.bytes -= indexed.size
+	d.counters.removed(reason)
+}
+
+// path names an entry's file after a hash of its key, since keys can hold
+// characters that aren't allowed in file names
+func (d *Disk) path(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(hash[:]))
+}
+
+// load indexes the entry files left in the directory by a previous run
+func (d *Disk) load() error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	// least recently written first, so the most recent are evicted last
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	now := d.now()
+	for _, info := range files {
+		file := filepath.Join(d.dir, info.Name())
+		if info.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(info.Name(), diskTempPrefix) {
+			os.Remove(file)
+			continue
+		}
+
+		entry, err := readDiskFile(file)
+		if err != nil || file != d.path(entry.Key) || !now.Before(entry.Expires) || transient(entry.Key) {
+			os.Remove(file)
+			continue
+		}
+
+		d.add(entry.Key, &diskEntry{file: file, size: info.Size(), expires: entry.Expires})
+	}
+
+	return nil
+}
+
+// writeDiskFile writes an entry file, returning its size
+func writeDiskFile(path string, entry *Entry) (size int64, err error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), diskTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	buffered := bufio.NewWriter(file)
+
+	header := make([]byte, len(diskMagic)+2)
+	copy(header, diskMagic)
+	binary.BigEndian.PutUint16(header[len(diskMagic):], diskVersion)
+
+	_, err = buffered.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeEntry(buffered, entry)
+	if err != nil {
+		return 0, err
+	}
+
+	err = buffered.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(file.Name(), path)
+}
+
+func readDiskFile(path string) (*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+
+	header := make([]byte, len(diskMagic)+2)
+	_, err = io.ReadFull(buffered, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrSnapshotFormat
+	} else if err != nil {
+		return nil, err
+	}
+
+	if string(header[:len(diskMagic)]) != diskMagic {
+		return nil, ErrSnapshotFormat
+	}
+
+	version := binary.BigEndian.Uint16(header[len(diskMagic):])
+	if version < 1 || version > diskVersion {
+		return nil, ErrSnapshotVersion
+	}
+
+	entry, err := readEntry(buffered, version)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrSnapshotFormat
+	}
+
+	return entry, err
+}
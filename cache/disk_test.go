@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDisk(t *testing.T, expiry int, maxBytes int64) (*Disk, string) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := NewDisk(dir, expiry, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return disk, dir
+}
+
+func TestDiskCreation(t *testing.T) {
+	if _, err := NewDisk(os.TempDir(), -1, 100); err != ErrNegativeValues {
+		t.Error("Negative expiry accepted")
+	}
+
+	if _, err := NewDisk(os.TempDir(), 100, 0); err != ErrUnbounded {
+		t.Error("Unbounded disk accepted")
+	}
+}
+
+func TestDiskPutGet(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	entry := newEntry("a/b c", []byte("value"), time.Hour, time.Hour, time.Now())
+	err := disk.Put(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := disk.Get("a/b c")
+	if stored == nil ||
+		!bytes.Equal(stored.Value, entry.Value) ||
+		stored.TTL != entry.TTL ||
+		!stored.Timestamp.Equal(entry.Timestamp) ||
+		stored.Tier != TierDisk {
+
+		t.Error("Entry not stored", stored)
+	}
+
+	// the disk expiry is shorter than the entry's TTL
+	if stored.Expires.After(time.Now().Add(time.Second)) {
+		t.Error("Disk expiry ignored")
+	}
+
+	if disk.Get("missing") != nil {
+		t.Error("Missing entry found")
+	}
+
+	if !disk.Delete("a/b c") || disk.Get("a/b c") != nil || disk.Len() != 0 || disk.Bytes() != 0 {
+		t.Error("Entry not deleted")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Error("Entry file not deleted")
+	}
+}
+
+func TestDiskExpiry(t *testing.T) {
+	disk, dir := tempDisk(t, 20, 1<<20)
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	disk.now = clock.Now
+
+	disk.Put(newEntry("a", []byte("a"), 0, time.Hour, clock.Now()))
+
+	// the source TTL runs out before the disk expiry
+	ttl := newEntry("b", []byte("b"), 5*time.Millisecond, time.Hour, clock.Now())
+	disk.Put(ttl)
+
+	if disk.Get("a") == nil || disk.Len() != 2 {
+		t.Error("Entry expired early")
+	}
+
+	clock.Advance(10 * time.Millisecond)
+	if disk.Get("b") != nil {
+		t.Error("Entry served past its source TTL")
+	}
+
+	clock.Advance(20 * time.Millisecond)
+	if disk.Get("a") != nil || disk.Len() != 0 || disk.Stats().Expirations != 2 {
+		t.Error("Entry served past the disk expiry")
+	}
+}
+
+func TestDiskMaxBytes(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	disk.Put(newEntry("a", []byte("a"), 0, time.Hour, time.Now()))
+	fileSize := disk.Bytes()
+	os.RemoveAll(dir)
+
+	disk, dir = tempDisk(t, 1000, 3*fileSize)
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"a", "b", "c"} {
+		disk.Put(newEntry(key, []byte(key), 0, time.Hour, time.Now()))
+	}
+
+	disk.Get("a")
+	disk.Put(newEntry("d", []byte("d"), 0, time.Hour, time.Now()))
+
+	if disk.Get("b") != nil ||
+		disk.Get("a") == nil ||
+		disk.Get("c") == nil ||
+		disk.Get("d") == nil ||
+		disk.Bytes() != 3*fileSize ||
+		disk.Stats().Evictions != 1 {
+
+		t.Error("Least recently used entry not evicted")
+	}
+
+	// an entry that can never fit isn't stored
+	disk.Put(newEntry("e", bytes.Repeat([]byte("e"), int(3*fileSize)), 0, time.Hour, time.Now()))
+	if disk.Get("e") != nil || disk.Len() != 3 {
+		t.Error("Oversized entry stored")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 {
+		t.Error("Entry files not cleaned up", len(files))
+	}
+}
+
+func TestDiskReload(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	disk.Put(newEntry("a", []byte("a"), 0, time.Hour, time.Now()))
+
+	// an entry that expired before the reload
+	disk.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	disk.Put(newEntry("b", []byte("b"), 0, time.Hour, disk.now()))
+
+	// files left behind by a crash
+	ioutil.WriteFile(filepath.Join(dir, diskTempPrefix+"123"), []byte("partial"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "corrupt"), []byte("SCDISK"), 0644)
+
+	reloaded, err := NewDisk(dir, 1000, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry := reloaded.Get("a"); entry == nil || string(entry.Value) != "a" {
+		t.Error("Entry not reloaded")
+	}
+
+	if reloaded.Get("b") != nil || reloaded.Len() != 1 {
+		t.Error("Expired entry reloaded")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Error("Leftover files not removed", len(files))
+	}
+}
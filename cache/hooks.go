@@ -0,0 +1,45 @@
+package cache
+
+// RemovalReason is why an entry left the cache
+type RemovalReason int
+
+const (
+	// ReasonEvicted entries were evicted to make room for others
+	ReasonEvicted RemovalReason = iota
+	// ReasonExpired entries expired, and were past any stale window
+	ReasonExpired
+	// ReasonDeleted entries were deleted with Delete or Clear
+	ReasonDeleted
+	// ReasonOverwritten entries were replaced by a newer value for their key
+	ReasonOverwritten
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case ReasonEvicted:
+		return "evicted"
+	case ReasonExpired:
+		return "expired"
+	case ReasonDeleted:
+		return "deleted"
+	case ReasonOverwritten:
+		return "overwritten"
+	}
+
+	return "unknown"
+}
+
+// RemovalHook is called with the key and value of each entry removed from a
+// cache, and the reason it was removed. Hooks run after the cache's mutex is
+// released, on the goroutine that removed the entry, so they may use the
+// cache, but can run after other changes to the same key
+type RemovalHook func(key string, value []byte, reason RemovalReason)
+
+// entryHook is how hooks are called internally, with the whole entry, so
+// internal hooks can see its metadata
+type entryHook func(entry *Entry, reason RemovalReason)
+
+type removal struct {
+	entry  *Entry
+	reason RemovalReason
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+type removed struct {
+	key    string
+	value  string
+	reason RemovalReason
+}
+
+func TestRemovalHooks(t *testing.T) {
+	var removals []removed
+	hook := func(key string, value []byte, reason RemovalReason) {
+		removals = append(removals, removed{key, string(value), reason})
+	}
+
+	lru, err := NewLRU(20, 2, WithRemovalHook(hook))
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("1"))
+	lru.Set("a", []byte("2"))
+	lru.Set("b", []byte("3"))
+	lru.Set("c", []byte("4"))
+	lru.Delete("b")
+
+	time.Sleep(30 * time.Millisecond)
+	lru.Get("c")
+
+	expected := []removed{
+		{"a", "1", ReasonOverwritten},
+		{"a", "2", ReasonEvicted},
+		{"b", "3", ReasonDeleted},
+		{"c", "4", ReasonExpired},
+	}
+
+	if len(removals) != len(expected) {
+		t.Fatal("Unexpected removals", removals)
+	}
+
+	for i := range expected {
+		if removals[i] != expected[i] {
+			t.Error("Unexpected removal", removals[i], "expected", expected[i])
+		}
+	}
+}
+
+func TestRemovalHookReasons(t *testing.T) {
+	reasons := make(map[RemovalReason]int)
+	hook := func(key string, value []byte, reason RemovalReason) {
+		reasons[reason]++
+	}
+
+	lru, err := NewLRU(20, 5, WithMaxBytes(4), WithRemovalHook(hook))
+	if err != nil {
+		panic(err)
+	}
+
+	// oversized values replace, rather than evict, the cached value
+	lru.Set("a", []byte("1"))
+	lru.Set("a", []byte("1234"))
+
+	lru.Set("b", []byte("1"))
+	lru.Set("c", []byte("1"))
+	lru.Clear()
+
+	lru.Set("d", []byte("1"))
+	time.Sleep(30 * time.Millisecond)
+	lru.Sweep(5)
+
+	if reasons[ReasonOverwritten] != 1 ||
+		reasons[ReasonDeleted] != 2 ||
+		reasons[ReasonExpired] != 1 ||
+		reasons[ReasonEvicted] != 0 {
+
+		t.Error("Unexpected removal reasons", reasons)
+	}
+}
+
+func TestRemovalHookReentry(t *testing.T) {
+	var lru *Memory
+
+	// a hook that uses the cache would deadlock if hooks held the mutex
+	hook := func(key string, value []byte, reason RemovalReason) {
+		if reason == ReasonEvicted {
+			lru.Get(key)
+			lru.Len()
+		}
+	}
+
+	var err error
+	lru, err = NewLRU(1000, 1, WithRemovalHook(hook))
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lru.Set("a", []byte("a"))
+		lru.Set("b", []byte("b"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Hook deadlocked the cache")
+	}
+}
+
+func TestShardedRemovalHooks(t *testing.T) {
+	evicted := make(chan string, 10)
+	hook := func(key string, value []byte, reason RemovalReason) {
+		evicted <- key
+	}
+
+	sharded, err := NewSharded(1000, 2, 2, WithRemovalHook(hook))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		sharded.Set(key, []byte(key))
+	}
+
+	if len(evicted) != 5-sharded.Len() {
+		t.Error("Shard evictions not reported")
+	}
+}
+
+func TestRemovalReasonString(t *testing.T) {
+	if ReasonEvicted.String() != "evicted" ||
+		ReasonOverwritten.String() != "overwritten" ||
+		RemovalReason(-1).String() != "unknown" {
+
+		t.Fail()
+	}
+}
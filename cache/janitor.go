@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSweepSample is how many entries each sweep checks, if not configured
+const defaultSweepSample = 20
+
+// janitor actively expires entries in the background, so entries that are
+// never read again don't take up capacity until they're evicted
+type janitor struct {
+	reclaimed uint64 // first, for 64 bit alignment of atomic operations
+
+	interval time.Duration
+	sample   int
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startJanitor calls sweep every interval. Like Redis' active expiry, it
+// sweeps again straight away while more than a quarter of each sample was
+// expired, since there are probably many more expired entries left
+func startJanitor(sweep func(sample int) int, interval time.Duration, sample int) *janitor {
+	if sample <= 0 {
+		sample = defaultSweepSample
+	}
+
+	j := &janitor{
+		interval: interval,
+		sample:   sample,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go j.run(sweep)
+
+	return j
+}
+
+func (j *janitor) run(sweep func(sample int) int) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			reclaimed := sweep(j.sample)
+			atomic.AddUint64(&j.reclaimed, uint64(reclaimed))
+
+			if reclaimed*4 <= j.sample || j.stopped() {
+				break
+			}
+		}
+	}
+}
+
+func (j *janitor) stopped() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops the janitor, waiting for any sweep in progress to finish
+func (j *janitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+
+	<-j.done
+}
+
+// Reclaimed returns how many expired entries the janitor has removed
+func (j *janitor) Reclaimed() uint64 {
+	return atomic.LoadUint64(&j.reclaimed)
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSweep(t *testing.T) {
+	lru, err := NewLRU(1000, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		lru.SetWithTTL(fmt.Sprintf("short%v", i), []byte("value"), 10*time.Millisecond)
+		lru.Set(fmt.Sprintf("long%v", i), []byte("value"))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	reclaimed := lru.Sweep(10)
+	if reclaimed != 5 {
+		t.Error("Wrong number of entries reclaimed", reclaimed)
+	}
+
+	// expired entries are gone from both the map and the list
+	if lru.Len() != 5 || storedLen(lru) != 5 || lru.Bytes() != 5*int64(len("long0value")) {
+		t.Fail()
+	}
+
+	if lru.Sweep(10) != 0 {
+		t.Error("Unexpired entries reclaimed")
+	}
+}
+
+func TestSweepSample(t *testing.T) {
+	lru, err := NewLRU(1000, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		lru.SetWithTTL(fmt.Sprintf("key%v", i), []byte("value"), time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if lru.Sweep(3) != 3 || storedLen(lru) != 7 {
+		t.Fail()
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	lru, err := NewLRU(1000, 100, WithJanitor(10*time.Millisecond, 0))
+	if err != nil {
+		panic(err)
+	}
+	defer lru.Close()
+
+	for i := 0; i < 50; i++ {
+		lru.SetWithTTL(fmt.Sprintf("key%v", i), []byte("value"), time.Millisecond)
+	}
+	lru.Set("long", []byte("value"))
+
+	// the janitor keeps sweeping while most of its samples are expired
+	time.Sleep(50 * time.Millisecond)
+
+	if storedLen(lru) != 1 || lru.Reclaimed() != 50 {
+		t.Error("Expired entries not reclaimed", storedLen(lru), lru.Reclaimed())
+	}
+}
+
+func TestJanitorClose(t *testing.T) {
+	lru, err := NewLRU(1000, 10, WithJanitor(time.Millisecond, 0))
+	if err != nil {
+		panic(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		lru.Close()
+		lru.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Janitor didn't stop")
+	}
+
+	select {
+	case <-lru.janitor.done:
+	default:
+		t.Error("Janitor still running after close")
+	}
+}
+
+func TestShardedJanitor(t *testing.T) {
+	sharded, err := NewSharded(1000, 100, 4, WithJanitor(10*time.Millisecond, 0))
+	if err != nil {
+		panic(err)
+	}
+	defer sharded.Close()
+
+	for _, shard := range sharded.shards {
+		if shard.janitor != nil {
+			t.Error("Shard running its own janitor")
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		sharded.SetWithTTL(fmt.Sprintf("key%v", i), []byte("value"), time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	remaining := 0
+	for _, shard := range sharded.shards {
+		remaining += storedLen(shard)
+	}
+
+	if remaining != 0 || sharded.Reclaimed() != 50 {
+		t.Error("Expired entries not reclaimed", remaining, sharded.Reclaimed())
+	}
+}
+
+// storedLen counts stored entries, whether expired or not, without racing the
+// janitor
+func storedLen(m *Memory) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.lookup)
+}
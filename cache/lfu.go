@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"container/list"
+)
+
+// lfuPolicy evicts the least frequently used key, breaking ties by evicting
+// the least recently used. Every operation is O(1): keys are kept in buckets
+// of equal use count, and the buckets in a list ordered by count.
+// Counts never decay, so keys that were popular long ago are hard to evict
+type lfuPolicy struct {
+	buckets *list.List // of *lfuBucket, least used first
+	items   map[string]*lfuItem
+}
+
+type lfuBucket struct {
+	count int
+	keys  *list.List // of *lfuItem, most recently used first
+}
+
+type lfuItem struct {
+	key     string
+	bucket  *list.Element // the item's bucket, in lfuPolicy.buckets
+	element *list.Element // the item, in its bucket's keys
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		buckets: list.New(),
+		items:   make(map[string]*lfuItem),
+	}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	front := p.buckets.Front()
+	if front == nil || front.Value.(*lfuBucket).count != 1 {
+		front = p.buckets.PushFront(&lfuBucket{count: 1, keys: list.New()})
+	}
+
+	item := &lfuItem{key: key, bucket: front}
+	item.element = front.Value.(*lfuBucket).keys.PushFront(item)
+	p.items[key] = item
+}
+
+func (p *lfuPolicy) Access(key string) {
+	item, exists := p.items[key]
+	if !exists {
+		return
+	}
+
+	current := item.bucket
+	count := current.Value.(*lfuBucket).count
+
+	next := current.Next()
+	if next == nil || next.Value.(*lfuBucket).count != count+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{count: count + 1, keys: list.New()}, current)
+	}
+
+	p.unlink(item)
+	item.bucket = next
+	item.element = next.Value.(*lfuBucket).keys.PushFront(item)
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	item, exists := p.items[key]
+	if !exists {
+		return
+	}
+
+	p.unlink(item)
+	delete(p.items, key)
+}
+
+func (p *lfuPolicy) Evict() string {
+	leastUsed := p.buckets.Front().Value.(*lfuBucket)
+	item := leastUsed.keys.Back().Value.(*lfuItem)
+
+	p.Remove(item.key)
+
+	return item.key
+}
+
+// Keys returns the most used keys first, and the most recently used first
+// among keys used equally often
+func (p *lfuPolicy) Keys() []string {
+	keys := make([]string, 0, len(p.items))
+	for bucket := p.buckets.Back(); bucket != nil; bucket = bucket.Prev() {
+		for element := bucket.Value.(*lfuBucket).keys.Front(); element != nil; element = element.Next() {
+			keys = append(keys, element.Value.(*lfuItem).key)
+		}
+	}
+
+	return keys
+}
+
+func (p *lfuPolicy) Clear() {
+	p.buckets.Init()
+	p.items = make(map[string]*lfuItem)
+}
+
+// unlink takes item out of its bucket, dropping the bucket if it's left empty
+func (p *lfuPolicy) unlink(item *lfuItem) {
+	bucket := item.bucket.Value.(*lfuBucket)
+	bucket.keys.Remove(item.element)
+
+	if bucket.keys.Len() == 0 {
+		p.buckets.Remove(item.bucket)
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestLFUPolicyOrder(t *testing.T) {
+	p := newLFUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Add("d")
+	p.Add("e")
+
+	p.Access("a")
+	p.Access("a")
+	p.Access("c")
+	p.Access("e")
+	p.Remove("d")
+
+	// least used first, and least recently used first among equals
+	checkOrder(t, "Keys", p.Keys(), []string{"a", "e", "c", "b"})
+	checkOrder(t, "Eviction", evictAll(p), []string{"b", "c", "e", "a"})
+}
+
+func TestLFUEviction(t *testing.T) {
+	m, err := NewMemory(1000, 3, WithPolicy(PolicyLFU))
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	d := []byte("d")
+
+	m.Set("a", a)
+	m.Set("b", b)
+	m.Set("c", []byte("c"))
+	m.Get("a")
+	m.Get("a")
+	m.Get("b")
+
+	// c is the least used, even though a and b were cached before it
+	m.Set("d", d)
+	if m.Peek("c") != nil {
+		t.Error("Least used key not evicted")
+	}
+
+	// and now d is, even though it's the most recently used
+	m.Set("e", []byte("e"))
+	if !cached(m, "a", a) ||
+		!cached(m, "b", b) ||
+		!cached(m, "d", nil) {
+
+		t.Fail()
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+// lruPolicy evicts the least recently used key
+type lruPolicy struct {
+	recency *keyList // most recently used first
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		recency: newKeyList(),
+	}
+}
+
+func (p *lruPolicy) Add(key string) {
+	p.recency.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	p.recency.MoveToFront(key)
+}
+
+func (p *lruPolicy) Remove(key string) {
+	p.recency.Remove(key)
+}
+
+func (p *lruPolicy) Evict() string {
+	return p.recency.PopBack()
+}
+
+func (p *lruPolicy) Keys() []string {
+	return p.recency.Keys()
+}
+
+func (p *lruPolicy) Clear() {
+	p.recency.Clear()
+}
@@ -0,0 +1,18 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestLRUPolicyOrder(t *testing.T) {
+	p := newLRUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Add("d")
+	p.Access("a")
+	p.Remove("c")
+
+	checkOrder(t, "Keys", p.Keys(), []string{"a", "d", "b"})
+	checkOrder(t, "Eviction", evictAll(p), []string{"b", "d", "a"})
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"time"
+)
+
+// Option configures optional cache behaviour, on top of expiry and capacity
+type Option func(*options)
+
+type options struct {
+	policy        string
+	maxBytes      int64
+	sweepInterval time.Duration
+	sweepSample   int
+	staleWindow   time.Duration
+	hooks         []entryHook
+
+	codec             string
+	compressThreshold int
+
+	jitter float64
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// negative returns whether any option was given a negative value
+func (o options) negative() bool {
+	return o.maxBytes < 0 || o.sweepInterval < 0 || o.staleWindow < 0 || o.compressThreshold < 0 || o.jitter < 0
+}
+
+// WithPolicy sets the eviction policy by name: PolicyLRU (the default),
+// PolicyLFU, Policy2Q, PolicyARC or PolicyWTinyLFU
+func WithPolicy(name string) Option {
+	return func(o *options) {
+		o.policy = name
+	}
+}
+
+// WithMaxBytes bounds the total size of cached keys and values, evicting
+// entries until the cache fits. 0 means no byte limit
+func WithMaxBytes(maxBytes int64) Option {
+	return func(o *options) {
+		o.maxBytes = maxBytes
+	}
+}
+
+// WithJanitor actively expires entries in the background, checking a random
+// sample of entries every interval until the cache is closed. A sample of 0
+// uses the default sample size
+func WithJanitor(interval time.Duration, sample int) Option {
+	return func(o *options) {
+		o.sweepInterval = interval
+		o.sweepSample = sample
+	}
+}
+
+// WithStaleWindow keeps entries for window after they expire, so GetStale can
+// still serve them while they're refreshed
+func WithStaleWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.staleWindow = window
+	}
+}
+
+// WithRemovalHook calls hook whenever an entry is evicted, expires, is deleted
+// or is overwritten. It can be given more than once, to register several hooks
+func WithRemovalHook(hook RemovalHook) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, func(entry *Entry, reason RemovalReason) {
+			// a value the cache compressed itself always decompresses
+			value, _ := entry.Decoded()
+			hook(entry.Key, value, reason)
+		})
+	}
+}
+
+// withDemotion moves entries evicted from the cache to the tiered cache's
+// disk tier, unless they've already expired, since the disk tier would give
+// them a new lifetime, or they're transient
+func withDemotion(t *Tiered) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, func(entry *Entry, reason RemovalReason) {
+			if reason == ReasonEvicted && t.disk.now().Before(entry.Expires) && !transient(entry.Key) {
+				t.demote(entry)
+			}
+		})
+	}
+}
+
+// WithCompression compresses values larger than threshold bytes with the named
+// codec, CodecGzip, CodecSnappy or CodecZstd, unless that doesn't make them smaller. Byte
+// limits count the compressed size. Entries keep values as stored, so readers
+// need Entry.Decoded to get the original value
+func WithCompression(codec string, threshold int) Option {
+	return func(o *options) {
+		o.codec = codec
+		o.compressThreshold = threshold
+	}
+}
+
+// WithJitter shortens each entry's lifetime by a random fraction of up to
+// jitter, which must be less than 1, so entries cached in the same burst
+// don't all expire at once
+func WithJitter(jitter float64) Option {
+	return func(o *options) {
+		o.jitter = jitter
+	}
+}
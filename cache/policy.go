@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+)
+
+var ErrUnknownPolicy = errors.New("unknown cache eviction policy")
+
+// Eviction policy names, for WithPolicy
+const (
+	PolicyLRU      = "lru"
+	PolicyLFU      = "lfu"
+	Policy2Q       = "2q"
+	PolicyARC      = "arc"
+	PolicyWTinyLFU = "wtinylfu"
+)
+
+// policy decides which key a Memory cache evicts next. Policies only track
+// keys: Memory holds the entries themselves, and calls every method with its
+// mutex held
+type policy interface {
+	// Add records a key that was just cached
+	Add(key string)
+	// Access records a cache hit, or an overwrite, on a cached key
+	Access(key string)
+	// Remove forgets a key that was deleted or expired
+	Remove(key string)
+	// Evict chooses a cached key to evict, and forgets it. Memory only calls
+	// Evict when at least one key is cached
+	Evict() string
+	// Keys returns every cached key, the last to be evicted first
+	Keys() []string
+	Clear()
+}
+
+// newPolicy creates the named policy, for a cache holding at most capacity
+// keys. A capacity of 0 means the key count is only bounded by a byte limit
+func newPolicy(name string, capacity int) (policy, error) {
+	switch name {
+	case PolicyLRU, "":
+		return newLRUPolicy(), nil
+	case PolicyLFU:
+		return newLFUPolicy(), nil
+	case Policy2Q:
+		return newTwoQueuePolicy(capacity), nil
+	case PolicyARC:
+		return newARCPolicy(capacity), nil
+	case PolicyWTinyLFU:
+		return newWTinyLFUPolicy(capacity), nil
+	}
+
+	return nil, ErrUnknownPolicy
+}
+
+// keyList is a list of keys, with constant time lookup of each key's element
+type keyList struct {
+	list     *list.List
+	elements map[string]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		list:     list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (l *keyList) Len() int {
+	return l.list.Len()
+}
+
+func (l *keyList) Contains(key string) bool {
+	_, exists := l.elements[key]
+	return exists
+}
+
+func (l *keyList) PushFront(key string) {
+	l.elements[key] = l.list.PushFront(key)
+}
+
+// MoveToFront moves key to the front, returning false if it isn't listed
+func (l *keyList) MoveToFront(key string) bool {
+	element, exists := l.elements[key]
+	if exists {
+		l.list.MoveToFront(element)
+	}
+
+	return exists
+}
+
+// Remove removes key, returning false if it isn't listed
+func (l *keyList) Remove(key string) bool {
+	element, exists := l.elements[key]
+	if exists {
+		l.list.Remove(element)
+		delete(l.elements, key)
+	}
+
+	return exists
+}
+
+// Back returns the key at the back of the list, which must not be empty
+func (l *keyList) Back() string {
+	return l.list.Back().Value.(string)
+}
+
+// PopBack removes and returns the key at the back of the list, which must not
+// be empty
+func (l *keyList) PopBack() string {
+	key := l.Back()
+	l.Remove(key)
+
+	return key
+}
+
+// Keys returns every key, front to back
+func (l *keyList) Keys() []string {
+	keys := make([]string, 0, l.list.Len())
+	for element := l.list.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(string))
+	}
+
+	return keys
+}
+
+func (l *keyList) Clear() {
+	l.list.Init()
+	l.elements = make(map[string]*list.Element)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var allPolicies = []string{PolicyLRU, PolicyLFU, Policy2Q, PolicyARC, PolicyWTinyLFU}
+
+func TestUnknownPolicy(t *testing.T) {
+	_, err := NewMemory(1000, 5, WithPolicy("mru"))
+	if err != ErrUnknownPolicy {
+		t.Error("Unknown policy accepted")
+	}
+
+	_, err = NewSharded(1000, 5, 2, WithPolicy("mru"))
+	if err != ErrUnknownPolicy {
+		t.Error("Unknown policy accepted by sharded cache")
+	}
+}
+
+func TestPolicyConsistency(t *testing.T) {
+	for _, name := range allPolicies {
+		for _, opts := range [][]Option{
+			{WithPolicy(name)},
+			{WithPolicy(name), WithMaxBytes(300)},
+		} {
+			m, err := NewMemory(1000, 50, opts...)
+			if err != nil {
+				panic(err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				key := fmt.Sprintf("key%v", random.Intn(200))
+
+				switch random.Intn(4) {
+				case 0:
+					m.Delete(key)
+				case 1:
+					m.Get(key)
+				default:
+					m.Set(key, make([]byte, random.Intn(10)))
+				}
+			}
+
+			checkConsistency(t, m)
+			if len(m.lookup) > 50 || m.bytes > 300 && m.maxBytes > 0 {
+				t.Error("Limits exceeded by", name, len(m.lookup), m.bytes)
+			}
+
+			m.Clear()
+			checkConsistency(t, m)
+		}
+	}
+}
+
+func TestKeyList(t *testing.T) {
+	keys := newKeyList()
+	keys.PushFront("a")
+	keys.PushFront("b")
+	keys.PushFront("c")
+
+	if !keys.MoveToFront("a") || keys.MoveToFront("missing") {
+		t.Fail()
+	}
+
+	if keys.PopBack() != "b" || !keys.Remove("c") || keys.Remove("c") {
+		t.Fail()
+	}
+
+	if keys.Len() != 1 || !keys.Contains("a") || keys.Keys()[0] != "a" {
+		t.Fail()
+	}
+}
+
+// evictAll empties a policy, returning keys in the order they were evicted
+func evictAll(p policy) (evicted []string) {
+	for len(p.Keys()) > 0 {
+		evicted = append(evicted, p.Evict())
+	}
+
+	return evicted
+}
+
+func checkOrder(t *testing.T, name string, got []string, expected []string) {
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Error(name, "got", got, "expected", expected)
+	}
+}
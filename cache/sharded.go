@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrInvalidShards = errors.New("shard count must be between 1 and the cache capacity and byte limit")
+
+// Sharded spreads keys over independently locked Memory segments, so that
+// concurrent requests for different keys don't all queue on one mutex.
+// Each shard runs its own eviction policy, so eviction across the whole
+// cache only approximately follows the policy
+type Sharded struct {
+	shards  []*Memory
+	janitor *janitor
+}
+
+// NewSharded splits capacity and any byte limit as evenly as possible over the
+// given number of shards, so the shards never exceed either limit in total
+func NewSharded(expiry int, capacity int, shards int, opts ...Option) (sharded *Sharded, err error) {
+	o := newOptions(opts)
+	if expiry < 0 || capacity < 0 || o.negative() {
+		return nil, ErrNegativeValues
+	}
+
+	if shards < 1 ||
+		(capacity > 0 && shards > capacity) ||
+		(o.maxBytes > 0 && int64(shards) > o.maxBytes) {
+
+		return nil, ErrInvalidShards
+	}
+
+	sharded = &Sharded{
+		shards: make([]*Memory, shards),
+	}
+
+	for i := range sharded.shards {
+		shardCapacity := capacity / shards
+		if i < capacity%shards {
+			shardCapacity++
+		}
+
+		// shards are swept by one shared janitor, rather than one each
+		shardOptions := o
+		shardOptions.sweepInterval = 0
+
+		shardOptions.maxBytes = o.maxBytes / int64(shards)
+		if int64(i) < o.maxBytes%int64(shards) {
+			shardOptions.maxBytes++
+		}
+
+		sharded.shards[i], err = newMemory(expiry, shardCapacity, shardOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.sweepInterval > 0 {
+		sharded.janitor = startJanitor(sharded.Sweep, o.sweepInterval, o.sweepSample)
+	}
+
+	return sharded, nil
+}
+
+func (s *Sharded) Get(key string) *Entry {
+	return s.shard(key).Get(key)
+}
+
+func (s *Sharded) GetStale(key string) (entry *Entry, stale bool) {
+	return s.shard(key).GetStale(key)
+}
+
+func (s *Sharded) Peek(key string) *Entry {
+	return s.shard(key).Peek(key)
+}
+
+func (s *Sharded) PeekStale(key string) (entry *Entry, stale bool) {
+	return s.shard(key).PeekStale(key)
+}
+
+func (s *Sharded) Set(key string, value []byte) {
+	s.shard(key).Set(key, value)
+}
+
+func (s *Sharded) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	s.shard(key).SetWithTTL(key, value, ttl)
+}
+
+func (s *Sharded) SetFetched(key string, value []byte, fetched Fetched) *Entry {
+	return s.shard(key).SetFetched(key, value, fetched)
+}
+
+func (s *Sharded) SetFetchedIf(key string, value []byte, fetched Fetched, valid func(current *Entry) bool) (*Entry, bool) {
+	return s.shard(key).SetFetchedIf(key, value, fetched, valid)
+}
+
+func (s *Sharded) Delete(key string) bool {
+	return s.shard(key).Delete(key)
+}
+
+func (s *Sharded) Len() (length int) {
+	for _, shard := range s.shards {
+		length += shard.Len()
+	}
+
+	return length
+}
+
+// Room returns the room left in all shards, or -1 if any shard has nothing to
+// estimate from. Keys that hash to a full shard still evict from it
+func (s *Sharded) Room() (room int) {
+	for _, shard := range s.shards {
+		shardRoom := shard.Room()
+		if shardRoom == -1 {
+			return -1
+		}
+
+		room += shardRoom
+	}
+
+	return room
+}
+
+// Bytes returns the total size of the keys and values cached in all shards
+func (s *Sharded) Bytes() (bytes int64) {
+	for _, shard := range s.shards {
+		bytes += shard.Bytes()
+	}
+
+	return bytes
+}
+
+func (s *Sharded) Clear() {
+	for _, shard := range s.shards {
+		shard.Clear()
+	}
+}
+
+// Sweep checks a sample of entries from every shard, sample in total, removing
+// any that have expired, and returns how many were removed
+func (s *Sharded) Sweep(sample int) (reclaimed int) {
+	shardSample := (sample + len(s.shards) - 1) / len(s.shards)
+	for _, shard := range s.shards {
+		reclaimed += shard.Sweep(shardSample)
+	}
+
+	return reclaimed
+}
+
+// Reclaimed returns how many expired entries the background janitor removed
+func (s *Sharded) Reclaimed() uint64 {
+	if s.janitor == nil {
+		return 0
+	}
+
+	return s.janitor.Reclaimed()
+}
+
+// Stats returns the sum of every shard's counters
+func (s *Sharded) Stats() (stats Stats) {
+	for _, shard := range s.shards {
+		stats = stats.add(shard.Stats())
+	}
+
+	return stats
+}
+
+func (s *Sharded) ResetStats() {
+	for _, shard := range s.shards {
+		shard.ResetStats()
+	}
+}
+
+// WriteSnapshot writes every shard's entries to one snapshot, so it can be
+// read back by a cache with a different number of shards
+func (s *Sharded) WriteSnapshot(w io.Writer) error {
+	var entries []*Entry
+	for _, shard := range s.shards {
+		entries = append(entries, shard.snapshotEntries()...)
+	}
+
+	return writeSnapshot(w, entries)
+}
+
+func (s *Sharded) ReadSnapshot(r io.Reader) error {
+	return readSnapshot(r, func(entry *Entry) {
+		s.shard(entry.Key).restore(entry)
+	})
+}
+
+// Close stops the background janitor, if there is one
+func (s *Sharded) Close() {
+	if s.janitor != nil {
+		s.janitor.Stop()
+	}
+}
+
+func (s *Sharded) shard(key string) *Memory {
+	return s.shards[fnv32a(key)%uint32(len(s.shards))]
+}
+
+// fnv32a is FNV-1a, inlined to avoid allocating a hash.Hash32 per lookup
+func fnv32a(key string) uint32 {
+	const offset32 = 2166136261
+	const prime32 = 16777619
+
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+
+	return hash
+}
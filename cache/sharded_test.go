@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardedCreation(t *testing.T) {
+	_, err := NewSharded(1000, 10, 4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = NewSharded(1000, 10, 0)
+	if err != ErrInvalidShards {
+		t.Error("Zero shards accepted")
+	}
+
+	_, err = NewSharded(1000, 3, 4)
+	if err != ErrInvalidShards {
+		t.Error("More shards than capacity accepted")
+	}
+
+	_, err = NewSharded(-1, 10, 4)
+	if err != ErrNegativeValues {
+		t.Error("Negative expiry accepted")
+	}
+}
+
+func TestShardedCapacity(t *testing.T) {
+	sharded, err := NewSharded(1000, 10, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	totalCapacity := 0
+	for _, shard := range sharded.shards {
+		totalCapacity += shard.capacity
+	}
+	if totalCapacity != 10 {
+		t.Error("Shard capacities don't add up to the total", totalCapacity)
+	}
+
+	for i := 0; i < 100; i++ {
+		sharded.Set(fmt.Sprintf("key%v", i), []byte("value"))
+	}
+
+	if sharded.Len() > 10 {
+		t.Error("Capacity exceeded", sharded.Len())
+	}
+
+	// the most recent key can never have been evicted
+	if !cached(sharded, "key99", []byte("value")) {
+		t.Fail()
+	}
+}
+
+func TestShardedMaxBytes(t *testing.T) {
+	sharded, err := NewSharded(1000, 0, 4, WithMaxBytes(1001))
+	if err != nil {
+		panic(err)
+	}
+
+	var totalBytes int64
+	for _, shard := range sharded.shards {
+		totalBytes += shard.maxBytes
+	}
+	if totalBytes != 1001 {
+		t.Error("Shard byte limits don't add up to the total", totalBytes)
+	}
+
+	for i := 0; i < 1000; i++ {
+		sharded.Set(fmt.Sprintf("key%v", i), []byte("value"))
+	}
+
+	if sharded.Bytes() > 1001 {
+		t.Error("Byte limit exceeded", sharded.Bytes())
+	}
+
+	_, err = NewSharded(1000, 0, 4, WithMaxBytes(3))
+	if err != ErrInvalidShards {
+		t.Error("More shards than bytes accepted")
+	}
+}
+
+func TestShardedOperations(t *testing.T) {
+	sharded, err := NewSharded(1000, 10, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	a := []byte("a")
+	b := []byte("b")
+	c := []byte("c")
+
+	sharded.Set("a", a)
+	sharded.Set("b", b)
+	sharded.Set("c", c)
+
+	if !cached(sharded, "a", a) ||
+		!cached(sharded, "b", b) ||
+		!cached(sharded, "c", c) ||
+		sharded.Len() != 3 {
+
+		t.Fail()
+	}
+
+	if !sharded.Delete("b") ||
+		!cached(sharded, "b", nil) ||
+		sharded.Len() != 2 {
+
+		t.Fail()
+	}
+
+	if entry, stale := sharded.GetStale("a"); entry == nil || stale {
+		t.Fail()
+	}
+
+	sharded.Clear()
+	if !cached(sharded, "a", nil) ||
+		!cached(sharded, "c", nil) {
+
+		t.Fail()
+	}
+}
@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrSnapshotFormat = errors.New("not a cache snapshot")
+var ErrSnapshotVersion = errors.New("unsupported cache snapshot version")
+var ErrSnapshotUnsupported = errors.New("cache can't be snapshotted")
+
+// Snapshots are binary, with every integer big endian:
+//
+//	magic   "SCSNAP"
+//	version uint16
+//	count   uint64, the number of entries
+//
+// followed by count entries, the first to be evicted first, each as:
+//
+//	key length    uint32, then the key
+//	value length  uint32, then the value
+//	timestamp     int64, in ns since the Unix epoch
+//	ttl           int64, in ns
+//	expires       int64, in ns since the Unix epoch
+//	codec length  uint32, then the codec the value is compressed with, if any
+//	type length   uint32, then the value's content type, if known
+//
+// Version 1 snapshots, from before values were compressed, have no codec, and
+// version 1 and 2 snapshots, from before content types were kept, have no type.
+// Restoring the entries in order rebuilds the eviction order, exactly for
+// LRU, and approximately for the other policies, whose history isn't saved
+const snapshotMagic = "SCSNAP"
+const snapshotVersion = 3
+
+// SaveSnapshot writes a snapshot of c, which must be a Snapshotter, to path.
+// The snapshot is written to a temporary file first, and renamed over path
+// once complete, so a crash mid-write never leaves a truncated snapshot behind
+func SaveSnapshot(c Cache, path string) (err error) {
+	snapshotter, ok := c.(Snapshotter)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	err = snapshotter.WriteSnapshot(file)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot at path into c, which must be a
+// Snapshotter. A missing snapshot isn't an error, since there's nothing to
+// restore the first time a cache starts
+func LoadSnapshot(c Cache, path string) error {
+	snapshotter, ok := c.(Snapshotter)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return snapshotter.ReadSnapshot(file)
+}
+
+// writeSnapshot writes a snapshot of entries, leaving out transient ones
+func writeSnapshot(w io.Writer, entries []*Entry) error {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !transient(entry.Key) {
+			kept = append(kept, entry)
+		}
+	}
+	entries = kept
+
+	buffered := bufio.NewWriter(w)
+
+	header := make([]byte, len(snapshotMagic)+2+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], snapshotVersion)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic)+2:], uint64(len(entries)))
+
+	_, err := buffered.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = writeEntry(buffered, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return buffered.Flush()
+}
+
+func writeEntry(w io.Writer, entry *Entry) error {
+	var fields [8]byte
+	for _, data := range [][]byte{[]byte(entry.Key), entry.Value} {
+		binary.BigEndian.PutUint32(fields[:4], uint32(len(data)))
+		_, err := w.Write(fields[:4])
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, field := range []int64{entry.Timestamp.UnixNano(), int64(entry.TTL), entry.Expires.UnixNano()} {
+		binary.BigEndian.PutUint64(fields[:], uint64(field))
+		_, err := w.Write(fields[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, data := range []string{entry.Encoding, entry.ContentType} {
+		binary.BigEndian.PutUint32(fields[:4], uint32(len(data)))
+		_, err := w.Write(fields[:4])
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(w, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshot calls restore with each entry in a snapshot, in order, except
+// for transient entries written before they were left out
+func readSnapshot(r io.Reader, restore func(entry *Entry)) error {
+	buffered := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+2+8)
+	_, err := io.ReadFull(buffered, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrSnapshotFormat
+	} else if err != nil {
+		return err
+	}
+
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrSnapshotFormat
+	}
+
+	version := binary.BigEndian.Uint16(header[len(snapshotMagic):])
+	if version < 1 || version > snapshotVersion {
+		return ErrSnapshotVersion
+	}
+
+	count := binary.BigEndian.Uint64(header[len(snapshotMagic)+2:])
+	for i := uint64(0); i < count; i++ {
+		entry, err := readEntry(buffered, version)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSnapshotFormat
+		} else if err != nil {
+			return err
+		}
+
+		if !transient(entry.Key) {
+			restore(entry)
+		}
+	}
+
+	return nil
+}
+
+// readEntry reads an entry written by writeEntry, in the given version of the
+// snapshot format
+func readEntry(r io.Reader, version uint16) (*Entry, error) {
+	key, err := readBlob(r)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := readBlob(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields [8]byte
+	var times [3]int64
+	for i := range times {
+		_, err = io.ReadFull(r, fields[:])
+		if err != nil {
+			return nil, err
+		}
+
+		times[i] = int64(binary.BigEndian.Uint64(fields[:]))
+	}
+
+	var encoding []byte
+	if version >= 2 {
+		encoding, err = readBlob(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var contentType []byte
+	if version >= 3 {
+		contentType, err = readBlob(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Entry{
+		Key:         string(key),
+		Value:       value,
+		Encoding:    string(encoding),
+		ContentType: string(contentType),
+		ETag:        etagFor(value),
+		Timestamp:   time.Unix(0, times[0]),
+		Size:        len(key) + len(value),
+		TTL:         time.Duration(times[1]),
+		Expires:     time.Unix(0, times[2]),
+	}, nil
+}
+
+// readBlob reads a uint32 length, followed by that many bytes
+func readBlob(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err = io.ReadFull(r, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
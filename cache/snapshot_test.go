@@ -0,0 +1,318 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("1"))
+	lru.SetWithTTL("b", []byte("2"), 500*time.Millisecond)
+	lru.SetFetched("c", []byte(""), Fetched{ContentType: "application/json"})
+	lru.Get("a")
+
+	var snapshot bytes.Buffer
+	err = lru.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restored.Keys(), []string{"a", "c", "b"}) {
+		t.Error("Recency order not restored", restored.Keys())
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		original := lru.Peek(key)
+		entry := restored.Peek(key)
+
+		if entry == nil ||
+			!bytes.Equal(entry.Value, original.Value) ||
+			!entry.Timestamp.Equal(original.Timestamp) ||
+			!entry.Expires.Equal(original.Expires) ||
+			entry.TTL != original.TTL ||
+			entry.Size != original.Size ||
+			entry.ContentType != original.ContentType {
+
+			t.Error("Entry not restored", key, entry, original)
+		}
+	}
+
+	if restored.Bytes() != lru.Bytes() {
+		t.Error("Bytes not restored")
+	}
+	checkConsistency(t, restored)
+}
+
+func TestSnapshotTransient(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("1"))
+	lru.Set(TransientPrefix+"b", []byte("2"))
+
+	var snapshot bytes.Buffer
+	err = lru.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restored.Keys(), []string{"a"}) {
+		t.Error("Transient entry snapshotted", restored.Keys())
+	}
+
+	// snapshots written before transient entries were left out skip them too
+	snapshot.Reset()
+	snapshot.WriteString(snapshotMagic)
+	snapshot.Write([]byte{0, snapshotVersion, 0, 0, 0, 0, 0, 0, 0, 1})
+	writeEntry(&snapshot, newEntry(TransientPrefix+"c", []byte("3"), 0, time.Hour, time.Now()))
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil || restored.Len() != 1 {
+		t.Error("Transient entry restored", err)
+	}
+}
+
+func TestSnapshotDropsExpired(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.SetWithTTL("a", []byte("1"), 20*time.Millisecond)
+	lru.Set("b", []byte("2"))
+
+	var snapshot bytes.Buffer
+	err = lru.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Peek("a") != nil || restored.Peek("b") == nil || len(restored.lookup) != 1 {
+		t.Error("Expired entry restored")
+	}
+
+	// a shorter expiry cuts restored entries short
+	snapshot.Reset()
+	lru.WriteSnapshot(&snapshot)
+
+	shorter, err := NewLRU(20, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = shorter.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shorter.Peek("b") != nil {
+		t.Error("Entry restored past the cache's expiry")
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	if lru.ReadSnapshot(bytes.NewReader(nil)) != ErrSnapshotFormat ||
+		lru.ReadSnapshot(bytes.NewBufferString("not a snapshot at all")) != ErrSnapshotFormat {
+
+		t.Error("Invalid snapshot read")
+	}
+
+	lru.Set("a", []byte("1"))
+
+	var snapshot bytes.Buffer
+	lru.WriteSnapshot(&snapshot)
+	data := snapshot.Bytes()
+
+	if lru.ReadSnapshot(bytes.NewReader(data[:len(data)-1])) != ErrSnapshotFormat {
+		t.Error("Truncated snapshot read")
+	}
+
+	data[len(snapshotMagic)+1]++
+	if lru.ReadSnapshot(bytes.NewReader(data)) != ErrSnapshotVersion {
+		t.Error("Unknown snapshot version read")
+	}
+}
+
+func TestShardedSnapshot(t *testing.T) {
+	sharded, err := NewSharded(1000, 10, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		sharded.Set(key, []byte(key))
+	}
+
+	var snapshot bytes.Buffer
+	err = sharded.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different shard count still restores every entry
+	restored, err := NewSharded(1000, 10, 3)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if !cached(restored, key, []byte(key)) {
+			t.Error("Entry not restored", key)
+		}
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.snapshot")
+
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	// nothing to restore yet
+	err = LoadSnapshot(lru, path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	lru.Set("a", []byte("1"))
+	err = SaveSnapshot(lru, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = LoadSnapshot(restored, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cached(restored, "a", []byte("1")) {
+		t.Error("Snapshot file not restored")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Error("Temporary snapshot left behind")
+	}
+}
+
+func TestSnapshotVersion1(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("1"))
+
+	var snapshot bytes.Buffer
+	lru.WriteSnapshot(&snapshot)
+
+	// version 1 entries were the same, without the codec and type at the end
+	data := snapshot.Bytes()
+	data = data[:len(data)-8]
+	data[len(snapshotMagic)+1] = 1
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(bytes.NewReader(data))
+	if err != nil || !cached(restored, "a", []byte("1")) {
+		t.Error("Version 1 snapshot not restored", err)
+	}
+}
+
+func TestSnapshotVersion2(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("1"))
+
+	var snapshot bytes.Buffer
+	lru.WriteSnapshot(&snapshot)
+
+	// version 2 entries were the same, without the type at the end
+	data := snapshot.Bytes()
+	data = data[:len(data)-4]
+	data[len(snapshotMagic)+1] = 2
+
+	restored, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	err = restored.ReadSnapshot(bytes.NewReader(data))
+	if err != nil || !cached(restored, "a", []byte("1")) {
+		t.Error("Version 2 snapshot not restored", err)
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of a cache's counters
+type Stats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Expirations uint64 `json:"expirations"`
+	Evictions   uint64 `json:"evictions"`
+	Sets        uint64 `json:"sets"`
+	Overwrites  uint64 `json:"overwrites"`
+	DiskHits    uint64 `json:"diskHits"` // hits served from a disk tier, also counted in Hits
+}
+
+// add returns the sum of two snapshots, for caches made of several caches
+func (s Stats) add(other Stats) Stats {
+	return Stats{
+		Hits:        s.Hits + other.Hits,
+		Misses:      s.Misses + other.Misses,
+		Expirations: s.Expirations + other.Expirations,
+		Evictions:   s.Evictions + other.Evictions,
+		Sets:        s.Sets + other.Sets,
+		Overwrites:  s.Overwrites + other.Overwrites,
+		DiskHits:    s.DiskHits + other.DiskHits,
+	}
+}
+
+// counters are updated atomically, so they can be read without the cache's
+// mutex. Each counter only resets to 0 individually, so a snapshot taken
+// during a reset may mix old and new counts
+type counters struct {
+	hits        uint64
+	misses      uint64
+	expirations uint64
+	evictions   uint64
+	sets        uint64
+	overwrites  uint64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Expirations: atomic.LoadUint64(&c.expirations),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Sets:        atomic.LoadUint64(&c.sets),
+		Overwrites:  atomic.LoadUint64(&c.overwrites),
+	}
+}
+
+func (c *counters) reset() {
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.expirations, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+	atomic.StoreUint64(&c.sets, 0)
+	atomic.StoreUint64(&c.overwrites, 0)
+}
+
+// removed counts a removal, if its reason has a counter
+func (c *counters) removed(reason RemovalReason) {
+	switch reason {
+	case ReasonExpired:
+		atomic.AddUint64(&c.expirations, 1)
+	case ReasonEvicted:
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
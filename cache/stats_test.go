@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	lru, err := NewLRU(20, 2)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	lru.Set("a", []byte("b"))
+	lru.Set("b", []byte("b"))
+	lru.Set("c", []byte("c"))
+
+	lru.Get("a")
+	lru.Get("b")
+	lru.Get("c")
+	lru.Peek("c")
+
+	time.Sleep(30 * time.Millisecond)
+	lru.Get("c")
+
+	expected := Stats{
+		Hits:        2,
+		Misses:      2,
+		Expirations: 1,
+		Evictions:   1,
+		Sets:        4,
+		Overwrites:  1,
+	}
+
+	if stats := lru.Stats(); stats != expected {
+		t.Error("Unexpected stats", stats)
+	}
+
+	lru.ResetStats()
+	if lru.Stats() != (Stats{}) {
+		t.Error("Stats not reset")
+	}
+}
+
+func TestStaleStats(t *testing.T) {
+	lru, err := NewLRU(20, 2, WithStaleWindow(time.Second))
+	if err != nil {
+		panic(err)
+	}
+
+	lru.Set("a", []byte("a"))
+	time.Sleep(30 * time.Millisecond)
+
+	lru.Get("a")
+	lru.GetStale("a")
+
+	// peeking at stale entries isn't counted
+	if entry, stale := lru.PeekStale("a"); entry == nil || !stale {
+		t.Error("Stale entry not peeked", entry)
+	}
+
+	if stats := lru.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Expirations != 0 {
+		t.Error("Unexpected stats", stats)
+	}
+}
+
+func TestShardedStats(t *testing.T) {
+	sharded, err := NewSharded(1000, 10, 4)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		sharded.Set(key, []byte(key))
+		sharded.Get(key)
+		sharded.Get(key + key)
+	}
+
+	if stats := sharded.Stats(); stats.Sets != 4 || stats.Hits != 4 || stats.Misses != 4 {
+		t.Error("Unexpected stats", stats)
+	}
+
+	sharded.ResetStats()
+	if sharded.Stats() != (Stats{}) {
+		t.Error("Stats not reset")
+	}
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tierGenerations is how many generation counters a Tiered cache spreads keys
+// over. Keys that share a counter also share invalidations, which only costs
+// them the odd promotion or demotion
+const tierGenerations = 1024
+
+// demotionQueue is how many evicted entries can wait to be written to disk.
+// Entries evicted while the queue is full aren't demoted, so requests never
+// wait on the disk tier to evict
+const demotionQueue = 256
+
+// Tiered is an in-memory cache backed by a disk tier. Entries evicted from
+// memory are demoted to disk in the background, and moved back into memory
+// when they're next read. Entries that expire in memory aren't demoted
+type Tiered struct {
+	memory      memoryTier
+	disk        *Disk
+	generations []uint64 // writes to the keys sharing each counter, see promote and demote
+
+	demotions chan demotion
+	stop      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// memoryTier is what Tiered needs of its memory tier, a Memory or Sharded
+// cache
+type memoryTier interface {
+	Cache
+	Snapshotter
+	StatsReporter
+	Bounded
+}
+
+// demotion is an evicted entry waiting to be written to disk, along with its
+// key's generation when it was evicted, or a request to close flushed once
+// every demotion queued before it is written
+type demotion struct {
+	entry      *Entry
+	generation uint64
+	flushed    chan struct{}
+}
+
+// NewTiered creates a memory tier like NewMemory, or like NewSharded if shards
+// is more than 1, which demotes evicted entries to disk
+func NewTiered(expiry int, capacity int, shards int, disk *Disk, opts ...Option) (tiered *Tiered, err error) {
+	tiered = &Tiered{
+		disk:        disk,
+		generations: make([]uint64, tierGenerations),
+		demotions:   make(chan demotion, demotionQueue),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	opts = append(opts, withDemotion(tiered))
+	if shards > 1 {
+		tiered.memory, err = NewSharded(expiry, capacity, shards, opts...)
+	} else {
+		tiered.memory, err = NewMemory(expiry, capacity, opts...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	go tiered.runDemotions()
+
+	return tiered, nil
+}
+
+// Get returns the entry cached in memory for key, or else on disk, with the
+// entry's Tier set to where it was found
+func (t *Tiered) Get(key string) *Entry {
+	if entry := t.memory.Get(key); entry != nil {
+		return entry
+	}
+
+	return t.promote(key)
+}
+
+// GetStale is like Get, but also returns entries from memory that have
+// expired within the memory tier's stale window. Entries on disk are never
+// served stale
+func (t *Tiered) GetStale(key string) (entry *Entry, stale bool) {
+	if entry, stale = t.memory.GetStale(key); entry != nil {
+		return entry, stale
+	}
+
+	return t.promote(key), false
+}
+
+// Peek returns the entry cached in memory for key, without looking on disk
+func (t *Tiered) Peek(key string) *Entry {
+	return t.memory.Peek(key)
+}
+
+// PeekStale is like Peek, for entries that can be served stale, which are only
+// ever in memory
+func (t *Tiered) PeekStale(key string) (entry *Entry, stale bool) {
+	return t.memory.PeekStale(key)
+}
+
+func (t *Tiered) Set(key string, value []byte) {
+	t.SetWithTTL(key, value, 0)
+}
+
+func (t *Tiered) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	t.SetFetched(key, value, Fetched{TTL: ttl})
+}
+
+func (t *Tiered) SetFetched(key string, value []byte, fetched Fetched) *Entry {
+	entry, _ := t.SetFetchedIf(key, value, fetched, nil)
+	return entry
+}
+
+// SetFetchedIf is like Memory.SetFetchedIf, for the memory tier. Any copy on
+// disk is deleted either way
+func (t *Tiered) SetFetchedIf(key string, value []byte, fetched Fetched, valid func(current *Entry) bool) (*Entry, bool) {
+	// the disk copy would be served again once the new value leaves memory
+	t.invalidate(key)
+	return t.memory.SetFetchedIf(key, value, fetched, valid)
+}
+
+func (t *Tiered) Delete(key string) bool {
+	onDisk := t.invalidate(key)
+	return t.memory.Delete(key) || onDisk
+}
+
+// Len returns the number of unexpired entries in both tiers
+func (t *Tiered) Len() int {
+	return t.memory.Len() + t.disk.Len()
+}
+
+// Room returns the room left in memory, since the disk tier only holds what
+// memory evicts
+func (t *Tiered) Room() int {
+	return t.memory.Room()
+}
+
+// Clear is like a Delete of every key, see invalidate
+func (t *Tiered) Clear() {
+	t.bumpAll()
+	t.disk.Clear()
+	t.bumpAll()
+	t.memory.Clear()
+}
+
+// Stats returns the sum of both tiers' counters, except for misses. Every miss
+// in memory is looked up on disk, so only misses on disk missed both tiers,
+// and hits + misses is the number of reads. Reads served from disk are also
+// counted as DiskHits
+func (t *Tiered) Stats() Stats {
+	memory, disk := t.memory.Stats(), t.disk.Stats()
+
+	stats := memory.add(disk)
+	stats.Misses = disk.Misses
+	stats.DiskHits = disk.Hits
+
+	return stats
+}
+
+func (t *Tiered) ResetStats() {
+	t.memory.ResetStats()
+	t.disk.ResetStats()
+}
+
+// WriteSnapshot writes the memory tier's entries, since the disk tier
+// persists itself
+func (t *Tiered) WriteSnapshot(w io.Writer) error {
+	return t.memory.WriteSnapshot(w)
+}
+
+func (t *Tiered) ReadSnapshot(r io.Reader) error {
+	return t.memory.ReadSnapshot(r)
+}
+
+// Close stops the memory tier, then writes any demotions still queued, so
+// they survive a restart
+func (t *Tiered) Close() {
+	t.memory.Close()
+
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+
+	<-t.done
+}
+
+// promote moves key's entry from disk into memory, returning the entry as it
+// was found on disk, or nil if it can't be served. Writes delete the disk
+// copy, then bump the key's generation, then write to memory, so if a write
+// has overtaken the promotion since it read from disk, the generation has
+// changed, or the write is yet to replace what's promoted. Entries are only
+// promoted to keys memory doesn't have, so they never replace a write, or
+// another promotion
+func (t *Tiered) promote(key string) *Entry {
+	generation := atomic.LoadUint64(t.generation(key))
+
+	entry := t.disk.Get(key)
+	if entry == nil {
+		return nil
+	}
+
+	// the entry lives no longer in memory than it had left on disk
+	value, err := entry.Decoded()
+	ttl := entry.Expires.Sub(t.disk.now())
+	if ttl <= 0 || err != nil {
+		t.disk.Delete(key)
+		return nil
+	}
+
+	_, promoted := t.memory.SetFetchedIf(key, value, Fetched{TTL: ttl, ContentType: entry.ContentType}, func(current *Entry) bool {
+		return current == nil && atomic.LoadUint64(t.generation(key)) == generation
+	})
+
+	if promoted {
+		t.disk.Delete(key)
+	}
+
+	return entry
+}
+
+// demote queues an entry evicted from memory to be written to disk, unless
+// the queue is full
+func (t *Tiered) demote(entry *Entry) {
+	queued := demotion{entry: entry, generation: atomic.LoadUint64(t.generation(entry.Key))}
+
+	select {
+	case t.demotions <- queued:
+	default:
+	}
+}
+
+// runDemotions writes queued demotions to disk until Close, and then writes
+// whatever is left in the queue
+func (t *Tiered) runDemotions() {
+	defer close(t.done)
+
+	for {
+		select {
+		case queued := <-t.demotions:
+			t.write(queued)
+		case <-t.stop:
+			for {
+				select {
+				case queued := <-t.demotions:
+					t.write(queued)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a demoted entry to disk, unless its key has been written since
+// it was evicted, or memory has the key again. Both are checked with the disk
+// tier locked, and writes bump the key's generation before they delete the
+// disk copy, so a write either stops the demotion, or deletes what it wrote
+func (t *Tiered) write(queued demotion) {
+	if queued.flushed != nil {
+		close(queued.flushed)
+		return
+	}
+
+	key := queued.entry.Key
+	err := t.disk.putIf(queued.entry, func() bool {
+		return atomic.LoadUint64(t.generation(key)) == queued.generation && t.memory.Peek(key) == nil
+	})
+
+	if err != nil {
+		log.Println("Demotion:", err)
+	}
+}
+
+// flush waits for every demotion queued so far to be written
+func (t *Tiered) flush() {
+	flushed := make(chan struct{})
+	t.demotions <- demotion{flushed: flushed}
+	<-flushed
+}
+
+// invalidate deletes key's disk copy for a write, returning whether there was
+// one. The generation is bumped before the delete for queued demotions, see
+// write, and after it for promotions, see promote
+func (t *Tiered) invalidate(key string) bool {
+	t.bump(key)
+	onDisk := t.disk.Delete(key)
+	t.bump(key)
+
+	return onDisk
+}
+
+// bump counts a write to key, see invalidate
+func (t *Tiered) bump(key string) {
+	atomic.AddUint64(t.generation(key), 1)
+}
+
+func (t *Tiered) bumpAll() {
+	for i := range t.generations {
+		atomic.AddUint64(&t.generations[i], 1)
+	}
+}
+
+func (t *Tiered) generation(key string) *uint64 {
+	return &t.generations[fnv32a(key)%tierGenerations]
+}
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTieredDemotion(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 2, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	tiered.SetFetched("a", []byte("a"), Fetched{ContentType: "text/plain"})
+	tiered.Set("b", []byte("b"))
+	tiered.Set("c", []byte("c"))
+	tiered.flush()
+
+	if disk.Len() != 1 || disk.Get("a") == nil || tiered.Len() != 3 {
+		t.Error("Evicted entry not demoted")
+	}
+
+	// a hit on disk promotes the entry, demoting the least recently used
+	entry := tiered.Get("a")
+	if entry == nil || string(entry.Value) != "a" || entry.Tier != TierDisk || entry.ContentType != "text/plain" {
+		t.Error("Demoted entry not served from disk")
+	}
+
+	if entry = tiered.Get("a"); entry == nil || entry.Tier != TierMemory || entry.ContentType != "text/plain" {
+		t.Error("Demoted entry not promoted")
+	}
+
+	tiered.flush()
+	if disk.Len() != 1 || disk.Get("b") == nil {
+		t.Error("Promotion didn't demote")
+	}
+}
+
+func TestTieredExpiry(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(20, 2, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	clock := newFakeClock()
+	tiered.memory.(*Memory).now = clock.Now
+	disk.now = clock.Now
+
+	tiered.Set("a", []byte("a"))
+	clock.Advance(30 * time.Millisecond)
+
+	// expired entries aren't demoted
+	if tiered.Get("a") != nil || disk.Len() != 0 {
+		t.Error("Expired entry demoted")
+	}
+
+	// nor are expired entries evicted before they're read
+	tiered.Set("a", []byte("old"))
+	clock.Advance(30 * time.Millisecond)
+	tiered.Set("x", []byte("x"))
+	tiered.Set("y", []byte("y"))
+	tiered.flush()
+
+	if tiered.Get("a") != nil || disk.Len() != 0 {
+		t.Error("Expired entry demoted on eviction")
+	}
+
+	// demoted source TTLs carry over to disk, and back to memory
+	tiered.SetWithTTL("b", []byte("b"), 15*time.Millisecond)
+	tiered.Set("c", []byte("c"))
+	tiered.Set("d", []byte("d"))
+	tiered.flush()
+
+	if disk.Get("b") == nil {
+		t.Fatal("Evicted entry not demoted")
+	}
+
+	clock.Advance(20 * time.Millisecond)
+	if tiered.Get("b") != nil {
+		t.Error("Demoted entry served past its TTL")
+	}
+}
+
+func TestTieredSetAndDelete(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 1, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	tiered.Set("a", []byte("old"))
+	tiered.Set("b", []byte("b"))
+
+	// a new value replaces the demoted one
+	tiered.Set("a", []byte("new"))
+	tiered.Set("c", []byte("c"))
+	tiered.flush()
+
+	if entry := tiered.Get("a"); entry == nil || string(entry.Value) != "new" {
+		t.Error("Demoted value served after an update")
+	}
+
+	if !tiered.Delete("b") || tiered.Get("b") != nil {
+		t.Error("Demoted entry not deleted")
+	}
+
+	tiered.Clear()
+	if tiered.Len() != 0 || disk.Len() != 0 {
+		t.Error("Tiers not cleared")
+	}
+}
+
+func TestTieredPromotion(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 2, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	tiered.Set("a", []byte("old"))
+	tiered.Set("b", []byte("b"))
+	tiered.Set("c", []byte("c"))
+	tiered.flush()
+
+	// a value that reached memory while the old one was read from disk
+	// isn't replaced by it
+	tiered.memory.Set("a", []byte("new"))
+	if entry := tiered.promote("a"); entry == nil || string(entry.Value) != "old" {
+		t.Error("Demoted entry not read")
+	}
+
+	if entry := tiered.Get("a"); entry == nil || string(entry.Value) != "new" || entry.Tier != TierMemory {
+		t.Error("Promotion replaced a newer value")
+	}
+}
+
+func TestTieredDemotionOvertaken(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 2, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	// a key deleted while its demotion was queued isn't written back to disk
+	entry := tiered.SetFetched("a", []byte("a"), Fetched{})
+	queued := demotion{entry: entry, generation: *tiered.generation("a")}
+
+	tiered.Delete("a")
+	tiered.write(queued)
+
+	if tiered.Get("a") != nil || disk.Len() != 0 {
+		t.Error("Deleted entry demoted")
+	}
+
+	// nor is one memory has again
+	tiered.Set("b", []byte("b"))
+	tiered.write(demotion{entry: tiered.Peek("b"), generation: *tiered.generation("b")})
+
+	if disk.Len() != 0 {
+		t.Error("Cached entry demoted")
+	}
+}
+
+func TestTieredTransient(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 1, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	// transient entries are dropped on eviction, rather than demoted
+	tiered.Set(TransientPrefix+"a", []byte("a"))
+	tiered.Set("b", []byte("b"))
+	tiered.flush()
+
+	if disk.Len() != 0 || tiered.Get(TransientPrefix+"a") != nil {
+		t.Error("Transient entry demoted")
+	}
+
+	disk.Put(newEntry(TransientPrefix+"c", []byte("c"), 0, time.Hour, time.Now()))
+	if disk.Len() != 0 {
+		t.Error("Transient entry stored on disk")
+	}
+}
+
+func TestTieredUnreadable(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 2, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	// a disk copy that doesn't decode is dropped, not served
+	entry := newEntry("a", []byte("not gzip"), 0, time.Hour, time.Now())
+	entry.Encoding = CodecGzip
+	disk.Put(entry)
+
+	if tiered.Get("a") != nil || disk.Len() != 0 {
+		t.Error("Undecodable entry served")
+	}
+}
+
+func TestTieredSharded(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 4, 2, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for _, key := range keys {
+		tiered.Set(key, []byte(key))
+	}
+	tiered.flush()
+
+	// each read promotes one entry and demotes another
+	for _, key := range keys {
+		tiered.flush()
+		if !cached(tiered, key, []byte(key)) {
+			t.Error("Entry lost", key)
+		}
+	}
+}
+
+func TestTieredStats(t *testing.T) {
+	disk, dir := tempDisk(t, 1000, 1<<20)
+	defer os.RemoveAll(dir)
+
+	tiered, err := NewTiered(1000, 1, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	tiered.Set("a", []byte("a"))
+	tiered.Set("b", []byte("b"))
+	tiered.flush()
+	tiered.ResetStats()
+
+	tiered.Get("b") // from memory
+	tiered.Get("a") // from disk
+	tiered.Get("c") // from neither
+
+	// a read served from disk isn't also a miss
+	if stats := tiered.Stats(); stats.Hits != 2 || stats.DiskHits != 1 || stats.Misses != 1 {
+		t.Error("Reads miscounted", stats)
+	}
+}
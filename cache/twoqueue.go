@@ -0,0 +1,88 @@
+package cache
+
+// twoQueuePolicy is the full 2Q policy (Johnson and Shasha, 1994). New keys
+// enter a FIFO queue, and are only promoted to the main LRU queue if they're
+// requested again after being evicted from the FIFO, while their key is still
+// remembered. A scan of keys that are each used once only churns the FIFO,
+// leaving the hot keys in the main queue alone
+type twoQueuePolicy struct {
+	capacity int
+	recent   *keyList // A1in: cached keys seen once, newest first
+	ghosts   *keyList // A1out: keys recently evicted from recent, newest first
+	frequent *keyList // Am: cached keys seen again, most recently used first
+}
+
+// Queue sizes, as fractions of the capacity, suggested by the 2Q paper
+const twoQueueRecentRatio = 0.25
+const twoQueueGhostRatio = 0.5
+
+func newTwoQueuePolicy(capacity int) *twoQueuePolicy {
+	return &twoQueuePolicy{
+		capacity: capacity,
+		recent:   newKeyList(),
+		ghosts:   newKeyList(),
+		frequent: newKeyList(),
+	}
+}
+
+func (p *twoQueuePolicy) Add(key string) {
+	if p.ghosts.Remove(key) {
+		p.frequent.PushFront(key)
+		return
+	}
+
+	p.recent.PushFront(key)
+}
+
+func (p *twoQueuePolicy) Access(key string) {
+	// hits in the FIFO don't count, since they're usually correlated
+	// references from the same burst of requests
+	p.frequent.MoveToFront(key)
+}
+
+func (p *twoQueuePolicy) Remove(key string) {
+	if !p.recent.Remove(key) {
+		p.frequent.Remove(key)
+	}
+}
+
+func (p *twoQueuePolicy) Evict() string {
+	if p.recent.Len() > p.queueSize(twoQueueRecentRatio) || p.frequent.Len() == 0 {
+		key := p.recent.PopBack()
+
+		p.ghosts.PushFront(key)
+		for p.ghosts.Len() > p.queueSize(twoQueueGhostRatio) {
+			p.ghosts.PopBack()
+		}
+
+		return key
+	}
+
+	return p.frequent.PopBack()
+}
+
+func (p *twoQueuePolicy) Keys() []string {
+	return append(p.frequent.Keys(), p.recent.Keys()...)
+}
+
+func (p *twoQueuePolicy) Clear() {
+	p.recent.Clear()
+	p.ghosts.Clear()
+	p.frequent.Clear()
+}
+
+// queueSize scales ratio by the capacity, or by the number of cached keys if
+// the cache only has a byte limit
+func (p *twoQueuePolicy) queueSize(ratio float64) int {
+	capacity := p.capacity
+	if capacity == 0 {
+		capacity = p.recent.Len() + p.frequent.Len()
+	}
+
+	size := int(float64(capacity) * ratio)
+	if size < 1 {
+		size = 1
+	}
+
+	return size
+}
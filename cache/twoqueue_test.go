@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTwoQueuePolicyOrder(t *testing.T) {
+	// the FIFO queue holds 2 keys before evicting, and 4 ghosts
+	p := newTwoQueuePolicy(8)
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Add("d")
+
+	if p.Evict() != "a" {
+		t.Error("FIFO not evicted first")
+	}
+
+	// a is remembered, so coming back promotes it to the main queue
+	p.Add("a")
+	p.Add("e")
+
+	// hits in the FIFO don't change its order
+	p.Access("b")
+
+	checkOrder(t, "Keys", p.Keys(), []string{"a", "e", "d", "c", "b"})
+	checkOrder(t, "Eviction", evictAll(p), []string{"b", "c", "a", "d", "e"})
+}
+
+func TestTwoQueueScanResistance(t *testing.T) {
+	m, err := NewMemory(1000, 4, WithPolicy(Policy2Q))
+	if err != nil {
+		panic(err)
+	}
+
+	hot := []byte("hot")
+	m.Set("hot", hot)
+	m.Set("x1", []byte("x"))
+	m.Set("x2", []byte("x"))
+	m.Set("x3", []byte("x"))
+	m.Set("x4", []byte("x"))
+
+	// hot was evicted from the FIFO, and is requested again
+	if !cached(m, "hot", nil) {
+		t.Fatal("FIFO not evicted first")
+	}
+	m.Set("hot", hot)
+
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprintf("scan%v", i), []byte("x"))
+	}
+
+	if !cached(m, "hot", hot) {
+		t.Error("Hot key flushed by a scan")
+	}
+}
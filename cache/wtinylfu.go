@@ -0,0 +1,238 @@
+package cache
+
+// wTinyLFUPolicy is the W-TinyLFU policy (Einziger, Friedman and Manes, 2017),
+// as used by Caffeine. New keys enter a small LRU window. Keys pushed out of
+// the window only get into the main cache if a frequency sketch estimates
+// they're used more often than the key the main cache would evict for them,
+// so one-off scans can't flush the hot set. The main cache is a segmented
+// LRU: keys hit on probation are promoted to a protected segment
+type wTinyLFUPolicy struct {
+	capacity  int
+	sketch    *countMinSketch
+	window    *keyList // most recently used first
+	probation *keyList // most recently used first
+	protected *keyList // most recently used first
+}
+
+// Segment sizes, as fractions of the capacity, as in Caffeine's defaults
+const wTinyLFUWindowRatio = 0.01
+const wTinyLFUProtectedRatio = 0.8
+
+// defaultSketchCapacity sizes the frequency sketch for caches only bounded by
+// a byte limit, whose key count isn't known up front
+const defaultSketchCapacity = 1024
+
+func newWTinyLFUPolicy(capacity int) *wTinyLFUPolicy {
+	sketchCapacity := capacity
+	if sketchCapacity == 0 {
+		sketchCapacity = defaultSketchCapacity
+	}
+
+	return &wTinyLFUPolicy{
+		capacity:  capacity,
+		sketch:    newCountMinSketch(sketchCapacity),
+		window:    newKeyList(),
+		probation: newKeyList(),
+		protected: newKeyList(),
+	}
+}
+
+func (p *wTinyLFUPolicy) Add(key string) {
+	p.sketch.Increment(key)
+	p.window.PushFront(key)
+
+	// with room to spare, keys leaving the window don't need admitting
+	if p.window.Len() > p.windowSize() {
+		p.probation.PushFront(p.window.PopBack())
+	}
+}
+
+func (p *wTinyLFUPolicy) Access(key string) {
+	p.sketch.Increment(key)
+
+	if p.window.MoveToFront(key) || p.protected.MoveToFront(key) {
+		return
+	}
+
+	if p.probation.Remove(key) {
+		p.protected.PushFront(key)
+
+		for p.protected.Len() > p.protectedSize() {
+			p.probation.PushFront(p.protected.PopBack())
+		}
+	}
+}
+
+func (p *wTinyLFUPolicy) Remove(key string) {
+	if !p.window.Remove(key) && !p.probation.Remove(key) {
+		p.protected.Remove(key)
+	}
+}
+
+func (p *wTinyLFUPolicy) Evict() string {
+	mainCache := p.probation
+	if mainCache.Len() == 0 {
+		mainCache = p.protected
+	}
+
+	if mainCache.Len() == 0 {
+		return p.window.PopBack()
+	}
+
+	// while the window has room, the main cache makes room for new keys
+	if p.window.Len() < p.windowSize() {
+		return mainCache.PopBack()
+	}
+
+	// the window's oldest key is about to be pushed out, so either it or the
+	// main cache's victim has to go
+	candidate := p.window.Back()
+	victim := mainCache.Back()
+
+	if p.sketch.Estimate(candidate) > p.sketch.Estimate(victim) {
+		mainCache.Remove(victim)
+		p.window.Remove(candidate)
+		p.probation.PushFront(candidate)
+
+		return victim
+	}
+
+	return p.window.PopBack()
+}
+
+func (p *wTinyLFUPolicy) Keys() []string {
+	keys := append(p.protected.Keys(), p.window.Keys()...)
+	return append(keys, p.probation.Keys()...)
+}
+
+func (p *wTinyLFUPolicy) Clear() {
+	p.sketch.Clear()
+	p.window.Clear()
+	p.probation.Clear()
+	p.protected.Clear()
+}
+
+func (p *wTinyLFUPolicy) windowSize() int {
+	return p.segmentSize(p.size(), wTinyLFUWindowRatio)
+}
+
+func (p *wTinyLFUPolicy) protectedSize() int {
+	return p.segmentSize(p.size()-p.windowSize(), wTinyLFUProtectedRatio)
+}
+
+func (p *wTinyLFUPolicy) segmentSize(size int, ratio float64) int {
+	segment := int(float64(size) * ratio)
+	if segment < 1 {
+		segment = 1
+	}
+
+	return segment
+}
+
+// size is the capacity, or the number of cached keys if the cache only has a
+// byte limit
+func (p *wTinyLFUPolicy) size() int {
+	if p.capacity > 0 {
+		return p.capacity
+	}
+
+	return p.window.Len() + p.probation.Len() + p.protected.Len()
+}
+
+// countMinSketch estimates how often keys were used, in a fixed amount of
+// memory, with 4 bit counters that may overestimate but never underestimate.
+// All counters are halved periodically, so old popularity fades
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint32
+	additions int
+	resetAt   int
+}
+
+const sketchDepth = 4
+const sketchMaxCount = 15
+
+// sketchSeeds give each row of the sketch a different hash of the key
+var sketchSeeds = [sketchDepth]uint32{0x97cb3127, 0xc4ceb9fe, 0x5b3e4c1d, 0x8f2a6e53}
+
+// newCountMinSketch sizes a sketch for a cache of capacity keys, with rows of
+// 4 counters per key, and ages it every 10 additions per key, like Caffeine
+func newCountMinSketch(capacity int) *countMinSketch {
+	// round up to a power of two, so rows can be indexed with a mask
+	size := 16
+	for size < 4*capacity {
+		size *= 2
+	}
+
+	sketch := &countMinSketch{
+		mask:    uint32(size - 1),
+		resetAt: 10 * capacity,
+	}
+
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, size)
+	}
+
+	return sketch
+}
+
+func (s *countMinSketch) Increment(key string) {
+	hash := fnv32a(key)
+	for i := range s.rows {
+		index := s.index(hash, i)
+		if s.rows[i][index] < sketchMaxCount {
+			s.rows[i][index]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *countMinSketch) Estimate(key string) uint8 {
+	hash := fnv32a(key)
+
+	estimate := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if count := s.rows[i][s.index(hash, i)]; count < estimate {
+			estimate = count
+		}
+	}
+
+	return estimate
+}
+
+func (s *countMinSketch) Clear() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] = 0
+		}
+	}
+
+	s.additions = 0
+}
+
+// age halves every counter
+func (s *countMinSketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+
+	s.additions /= 2
+}
+
+func (s *countMinSketch) index(hash uint32, row int) uint32 {
+	// mix the seeded hash, so rows with nearby seeds don't collide together
+	h := hash ^ sketchSeeds[row]
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h & s.mask
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWTinyLFUPolicyOrder(t *testing.T) {
+	// a window, probation and protected segment of 1 key each
+	p := newWTinyLFUPolicy(3)
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+
+	// hits on probation are promoted to protected
+	p.Access("a")
+	p.Access("a")
+	checkOrder(t, "Keys", p.Keys(), []string{"a", "c", "b"})
+
+	// c is no more popular than b, so isn't admitted in b's place
+	if p.Evict() != "c" {
+		t.Error("Unpopular window key admitted")
+	}
+
+	p.Add("d")
+	p.Access("d")
+	p.Access("d")
+
+	// d is more popular than b, so takes its place
+	if p.Evict() != "b" {
+		t.Error("Popular window key not admitted")
+	}
+
+	checkOrder(t, "Keys", p.Keys(), []string{"a", "d"})
+}
+
+func TestWTinyLFUScanResistance(t *testing.T) {
+	m, err := NewMemory(1000, 100, WithPolicy(PolicyWTinyLFU))
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("hot%v", i)
+		m.Set(key, []byte("hot"))
+		for j := 0; j < 4; j++ {
+			m.Get(key)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.Set(fmt.Sprintf("scan%v", i), []byte("x"))
+	}
+
+	hot := 0
+	for i := 0; i < 50; i++ {
+		if m.Peek(fmt.Sprintf("hot%v", i)) != nil {
+			hot++
+		}
+	}
+
+	if hot < 45 {
+		t.Error("Hot keys flushed by a scan, only kept", hot)
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(16)
+
+	for i := 0; i < 5; i++ {
+		sketch.Increment("a")
+	}
+	sketch.Increment("b")
+
+	if sketch.Estimate("a") < 5 || sketch.Estimate("b") < 1 {
+		t.Error("Sketch underestimated")
+	}
+
+	for i := 0; i < 20; i++ {
+		sketch.Increment("a")
+	}
+	if sketch.Estimate("a") != sketchMaxCount {
+		t.Error("Sketch counter not saturated", sketch.Estimate("a"))
+	}
+
+	// aging halves every counter
+	sketch.age()
+	if sketch.Estimate("a") != sketchMaxCount/2 {
+		t.Error("Sketch not aged", sketch.Estimate("a"))
+	}
+
+	sketch.Clear()
+	if sketch.Estimate("a") != 0 {
+		t.Fail()
+	}
+}
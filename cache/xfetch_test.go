@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	if _, err := NewLRU(1000, 5, WithJitter(-0.1)); err != ErrNegativeValues {
+		t.Error("Negative jitter accepted")
+	}
+
+	if _, err := NewLRU(1000, 5, WithJitter(1)); err != ErrInvalidJitter {
+		t.Error("Jitter of 1 accepted")
+	}
+
+	lru, err := NewLRU(1000, 100, WithJitter(0.5))
+	if err != nil {
+		panic(err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	expires := make(map[time.Duration]bool)
+	for _, key := range keys {
+		lru.Set(key, []byte(key))
+
+		entry := lru.Peek(key)
+		lifetime := entry.Expires.Sub(entry.Timestamp)
+		if lifetime < 500*time.Millisecond || lifetime > time.Second {
+			t.Error("Jitter out of range", lifetime)
+		}
+
+		expires[lifetime] = true
+	}
+
+	if len(expires) == 1 {
+		t.Error("Expiry not jittered")
+	}
+}
+
+func TestExpiresEarly(t *testing.T) {
+	lru, err := NewLRU(1000, 5)
+	if err != nil {
+		panic(err)
+	}
+
+	lru.SetFetched("slow", []byte("a"), Fetched{FetchTime: time.Hour})
+	lru.SetFetched("fast", []byte("a"), Fetched{FetchTime: time.Nanosecond})
+	lru.Set("unknown", []byte("a"))
+
+	now := time.Now()
+	if lru.Get("slow").FetchTime != time.Hour {
+		t.Error("Fetch time not kept")
+	}
+
+	// a fetch much slower than the time left almost always refreshes early
+	early := 0
+	for i := 0; i < 100; i++ {
+		if lru.Get("slow").ExpiresEarly(1, now) {
+			early++
+		}
+	}
+
+	if early < 95 {
+		t.Error("Slow entry rarely refreshed early", early)
+	}
+
+	for i := 0; i < 100; i++ {
+		if lru.Get("fast").ExpiresEarly(1, now) ||
+			lru.Get("unknown").ExpiresEarly(1, now) ||
+			lru.Get("slow").ExpiresEarly(0, now) {
+
+			t.Fatal("Entry refreshed early")
+		}
+	}
+
+	// at expiry, every entry with a fetch time refreshes
+	if !lru.Get("fast").ExpiresEarly(1, lru.Get("fast").Expires) {
+		t.Error("Entry not refreshed at expiry")
+	}
+}
@@ -10,6 +10,7 @@ import (
 )
 
 var ErrMissingConfigField = errors.New("missing config field")
+var ErrInvalidBreakerFailureRate = errors.New("breaker failure rate must be above 0 and at most 1, or 0 to disable the breaker")
 
 // Config info for Proxy and Redis
 type Config struct {
@@ -17,6 +18,44 @@ type Config struct {
 	ProxyPort     int
 	CacheExpiry   int
 	CacheCapacity int
+	CacheMaxBytes int64
+	CacheShards   int
+	CachePolicy   string
+
+	CacheCompression       string
+	CacheCompressThreshold int
+
+	CacheSweepInterval int
+	CacheSweepSample   int
+
+	StaleWhileRevalidate int
+	MaxStale             int
+	CacheJitter          float64
+	EarlyRefreshBeta     float64
+
+	NegativeCacheExpiry   int
+	NegativeCacheCapacity int
+
+	DisableCacheHeaders bool
+
+	BreakerFailureRate float64
+	BreakerMinRequests int
+	BreakerWindow      int
+	BreakerCooldown    int
+
+	RedisReadTimeout int
+	RedisTimeout     int
+
+	SnapshotFile     string
+	SnapshotInterval int
+
+	WarmupKeyFile string
+	WarmupPattern string
+	WarmupBudget  int
+
+	DiskDir      string
+	DiskExpiry   int
+	DiskMaxBytes int64
 }
 
 // LoadConfig loads config from file and ENV, ENV taking precedence
@@ -38,13 +77,20 @@ func LoadConfig(configFile string) (conf *Config, err error) {
 	if config.RedisAddress == "" ||
 		config.ProxyPort == 0 ||
 		config.CacheExpiry == 0 ||
-		config.CacheCapacity == 0 {
+		(config.CacheCapacity == 0 && config.CacheMaxBytes == 0) ||
+		(config.DiskDir != "" && (config.DiskExpiry == 0 || config.DiskMaxBytes == 0)) {
 
 		err = ErrMissingConfigField
 		fmt.Println("test")
 		return
 	}
 
+	// NaN fails both comparisons, so it's rejected too
+	if config.BreakerFailureRate != 0 && !(config.BreakerFailureRate > 0 && config.BreakerFailureRate <= 1) {
+		err = ErrInvalidBreakerFailureRate
+		return
+	}
+
 	return &config, nil
 }
 
@@ -83,5 +129,249 @@ func prioritizeEnvConfig(config *Config) (err error) {
 		config.CacheCapacity = cacheCapacityInt
 	}
 
+	if cacheMaxBytes := os.Getenv("CACHEMAXBYTES"); cacheMaxBytes != "" {
+		var cacheMaxBytesInt int64
+		cacheMaxBytesInt, err = strconv.ParseInt(cacheMaxBytes, 10, 64)
+		if err != nil {
+			return
+		}
+
+		config.CacheMaxBytes = cacheMaxBytesInt
+	}
+
+	if cacheShards := os.Getenv("CACHESHARDS"); cacheShards != "" {
+		var cacheShardsInt int
+		cacheShardsInt, err = strconv.Atoi(cacheShards)
+		if err != nil {
+			return
+		}
+
+		config.CacheShards = cacheShardsInt
+	}
+
+	if cachePolicy := os.Getenv("CACHEPOLICY"); cachePolicy != "" {
+		config.CachePolicy = cachePolicy
+	}
+
+	if cacheCompression := os.Getenv("CACHECOMPRESSION"); cacheCompression != "" {
+		config.CacheCompression = cacheCompression
+	}
+
+	if cacheCompressThreshold := os.Getenv("CACHECOMPRESSTHRESHOLD"); cacheCompressThreshold != "" {
+		var cacheCompressThresholdInt int
+		cacheCompressThresholdInt, err = strconv.Atoi(cacheCompressThreshold)
+		if err != nil {
+			return
+		}
+
+		config.CacheCompressThreshold = cacheCompressThresholdInt
+	}
+
+	if cacheSweepInterval := os.Getenv("CACHESWEEPINTERVAL"); cacheSweepInterval != "" {
+		var cacheSweepIntervalInt int
+		cacheSweepIntervalInt, err = strconv.Atoi(cacheSweepInterval)
+		if err != nil {
+			return
+		}
+
+		config.CacheSweepInterval = cacheSweepIntervalInt
+	}
+
+	if cacheSweepSample := os.Getenv("CACHESWEEPSAMPLE"); cacheSweepSample != "" {
+		var cacheSweepSampleInt int
+		cacheSweepSampleInt, err = strconv.Atoi(cacheSweepSample)
+		if err != nil {
+			return
+		}
+
+		config.CacheSweepSample = cacheSweepSampleInt
+	}
+
+	if staleWhileRevalidate := os.Getenv("STALEWHILEREVALIDATE"); staleWhileRevalidate != "" {
+		var staleWhileRevalidateInt int
+		staleWhileRevalidateInt, err = strconv.Atoi(staleWhileRevalidate)
+		if err != nil {
+			return
+		}
+
+		config.StaleWhileRevalidate = staleWhileRevalidateInt
+	}
+
+	if maxStale := os.Getenv("MAXSTALE"); maxStale != "" {
+		var maxStaleInt int
+		maxStaleInt, err = strconv.Atoi(maxStale)
+		if err != nil {
+			return
+		}
+
+		config.MaxStale = maxStaleInt
+	}
+
+	if cacheJitter := os.Getenv("CACHEJITTER"); cacheJitter != "" {
+		var cacheJitterFloat float64
+		cacheJitterFloat, err = strconv.ParseFloat(cacheJitter, 64)
+		if err != nil {
+			return
+		}
+
+		config.CacheJitter = cacheJitterFloat
+	}
+
+	if earlyRefreshBeta := os.Getenv("EARLYREFRESHBETA"); earlyRefreshBeta != "" {
+		var earlyRefreshBetaFloat float64
+		earlyRefreshBetaFloat, err = strconv.ParseFloat(earlyRefreshBeta, 64)
+		if err != nil {
+			return
+		}
+
+		config.EarlyRefreshBeta = earlyRefreshBetaFloat
+	}
+
+	if negativeCacheExpiry := os.Getenv("NEGATIVECACHEEXPIRY"); negativeCacheExpiry != "" {
+		var negativeCacheExpiryInt int
+		negativeCacheExpiryInt, err = strconv.Atoi(negativeCacheExpiry)
+		if err != nil {
+			return
+		}
+
+		config.NegativeCacheExpiry = negativeCacheExpiryInt
+	}
+
+	if negativeCacheCapacity := os.Getenv("NEGATIVECACHECAPACITY"); negativeCacheCapacity != "" {
+		var negativeCacheCapacityInt int
+		negativeCacheCapacityInt, err = strconv.Atoi(negativeCacheCapacity)
+		if err != nil {
+			return
+		}
+
+		config.NegativeCacheCapacity = negativeCacheCapacityInt
+	}
+
+	if disableCacheHeaders := os.Getenv("DISABLECACHEHEADERS"); disableCacheHeaders != "" {
+		var disableCacheHeadersBool bool
+		disableCacheHeadersBool, err = strconv.ParseBool(disableCacheHeaders)
+		if err != nil {
+			return
+		}
+
+		config.DisableCacheHeaders = disableCacheHeadersBool
+	}
+
+	if breakerFailureRate := os.Getenv("BREAKERFAILURERATE"); breakerFailureRate != "" {
+		var breakerFailureRateFloat float64
+		breakerFailureRateFloat, err = strconv.ParseFloat(breakerFailureRate, 64)
+		if err != nil {
+			return
+		}
+
+		config.BreakerFailureRate = breakerFailureRateFloat
+	}
+
+	if breakerMinRequests := os.Getenv("BREAKERMINREQUESTS"); breakerMinRequests != "" {
+		var breakerMinRequestsInt int
+		breakerMinRequestsInt, err = strconv.Atoi(breakerMinRequests)
+		if err != nil {
+			return
+		}
+
+		config.BreakerMinRequests = breakerMinRequestsInt
+	}
+
+	if breakerWindow := os.Getenv("BREAKERWINDOW"); breakerWindow != "" {
+		var breakerWindowInt int
+		breakerWindowInt, err = strconv.Atoi(breakerWindow)
+		if err != nil {
+			return
+		}
+
+		config.BreakerWindow = breakerWindowInt
+	}
+
+	if breakerCooldown := os.Getenv("BREAKERCOOLDOWN"); breakerCooldown != "" {
+		var breakerCooldownInt int
+		breakerCooldownInt, err = strconv.Atoi(breakerCooldown)
+		if err != nil {
+			return
+		}
+
+		config.BreakerCooldown = breakerCooldownInt
+	}
+
+	if redisReadTimeout := os.Getenv("REDISREADTIMEOUT"); redisReadTimeout != "" {
+		var redisReadTimeoutInt int
+		redisReadTimeoutInt, err = strconv.Atoi(redisReadTimeout)
+		if err != nil {
+			return
+		}
+
+		config.RedisReadTimeout = redisReadTimeoutInt
+	}
+
+	if redisTimeout := os.Getenv("REDISTIMEOUT"); redisTimeout != "" {
+		var redisTimeoutInt int
+		redisTimeoutInt, err = strconv.Atoi(redisTimeout)
+		if err != nil {
+			return
+		}
+
+		config.RedisTimeout = redisTimeoutInt
+	}
+
+	if snapshotFile := os.Getenv("SNAPSHOTFILE"); snapshotFile != "" {
+		config.SnapshotFile = snapshotFile
+	}
+
+	if snapshotInterval := os.Getenv("SNAPSHOTINTERVAL"); snapshotInterval != "" {
+		var snapshotIntervalInt int
+		snapshotIntervalInt, err = strconv.Atoi(snapshotInterval)
+		if err != nil {
+			return
+		}
+
+		config.SnapshotInterval = snapshotIntervalInt
+	}
+
+	if warmupKeyFile := os.Getenv("WARMUPKEYFILE"); warmupKeyFile != "" {
+		config.WarmupKeyFile = warmupKeyFile
+	}
+
+	if warmupPattern := os.Getenv("WARMUPPATTERN"); warmupPattern != "" {
+		config.WarmupPattern = warmupPattern
+	}
+
+	if warmupBudget := os.Getenv("WARMUPBUDGET"); warmupBudget != "" {
+		var warmupBudgetInt int
+		warmupBudgetInt, err = strconv.Atoi(warmupBudget)
+		if err != nil {
+			return
+		}
+
+		config.WarmupBudget = warmupBudgetInt
+	}
+
+	if diskDir := os.Getenv("DISKDIR"); diskDir != "" {
+		config.DiskDir = diskDir
+	}
+
+	if diskExpiry := os.Getenv("DISKEXPIRY"); diskExpiry != "" {
+		var diskExpiryInt int
+		diskExpiryInt, err = strconv.Atoi(diskExpiry)
+		if err != nil {
+			return
+		}
+
+		config.DiskExpiry = diskExpiryInt
+	}
+
+	if diskMaxBytes := os.Getenv("DISKMAXBYTES"); diskMaxBytes != "" {
+		var diskMaxBytesInt int64
+		diskMaxBytesInt, err = strconv.ParseInt(diskMaxBytes, 10, 64)
+		if err != nil {
+			return
+		}
+
+		config.DiskMaxBytes = diskMaxBytesInt
+	}
+
 	return nil
 }
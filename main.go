@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-redis/redis"
 
@@ -15,24 +19,141 @@ import (
 
 const CONFIGFILE = "config.toml"
 
+// SHUTDOWNTIMEOUT is how long in-flight requests get to finish on shutdown
+const SHUTDOWNTIMEOUT = 10 * time.Second
+
 func main() {
 	conf := getConfig()
 	fmt.Println("Config read", *conf)
 	fmt.Println()
 
-	redisClient, pong := connectRedis(conf.RedisAddress)
+	redisClient, pong := connectRedis(conf.RedisAddress, time.Duration(conf.RedisReadTimeout)*time.Millisecond)
 	fmt.Println("Successfully connected to redis, with a ping for a", pong, "| Client:", redisClient)
 	fmt.Println()
 
-	lru, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	c, err := newCache(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	if conf.SnapshotFile != "" {
+		err = cache.LoadSnapshot(c, conf.SnapshotFile)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Restored", c.Len(), "cached keys from", conf.SnapshotFile)
+
+		if conf.SnapshotInterval > 0 {
+			go snapshotEvery(c, conf.SnapshotFile, time.Duration(conf.SnapshotInterval)*time.Millisecond)
+		}
+	}
+
+	proxyOpts, err := proxyOptions(conf)
 	if err != nil {
 		panic(err)
 	}
 
-	http.HandleFunc("/", proxy.RedisProxyHandler(redisClient, lru))
+	counters := &proxy.Counters{}
+	proxyOpts = append(proxyOpts, proxy.WithCounters(counters))
+
+	// the main and /_mget handlers share one breaker, since they share Redis
+	if conf.BreakerFailureRate > 0 {
+		breaker := proxy.NewBreaker(conf.BreakerFailureRate, conf.BreakerMinRequests,
+			time.Duration(conf.BreakerWindow)*time.Millisecond, time.Duration(conf.BreakerCooldown)*time.Millisecond)
+		proxyOpts = append(proxyOpts, proxy.WithBreaker(breaker))
+		http.HandleFunc(proxy.BREAKER_PATH, proxy.BreakerHandler(breaker))
+	}
+
+	p := proxy.New(redisClient, c, proxyOpts...)
+	http.HandleFunc("/", p.Handler())
+	http.HandleFunc(proxy.MGET_PATH, p.MGetHandler())
+	http.HandleFunc(proxy.STATS_PATH, proxy.StatsHandler(c, counters))
+
+	// serve while warming up, reporting ready once the cache is warm
+	readiness := &proxy.Readiness{}
+	http.HandleFunc(proxy.READY_PATH, proxy.ReadyHandler(readiness))
+	go func() {
+		warmUp(conf, redisClient, p)
+		readiness.SetReady()
+	}()
 	portString := fmt.Sprintf(":%v", conf.ProxyPort)
+	server := &http.Server{Addr: portString}
+	go shutdownOnSignal(server)
+
 	fmt.Println("Server running on port", conf.ProxyPort)
-	log.Fatal(http.ListenAndServe(portString, nil))
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	c.Close()
+	if conf.SnapshotFile != "" {
+		err = cache.SaveSnapshot(c, conf.SnapshotFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Saved", c.Len(), "cached keys to", conf.SnapshotFile)
+	}
+}
+
+// warmUp fills the cache from Redis, with the keys listed in the configured
+// key file, or else the keys matching the configured SCAN pattern, if any
+func warmUp(conf *config.Config, redisClient *redis.Client, p *proxy.Proxy) {
+	var keys proxy.KeySource
+
+	if conf.WarmupKeyFile != "" {
+		file, err := os.Open(conf.WarmupKeyFile)
+		if err != nil {
+			log.Println("Warm-up:", err)
+			return
+		}
+		defer file.Close()
+
+		keys = proxy.ReaderKeys(file)
+	} else if conf.WarmupPattern != "" {
+		keys = proxy.ScanKeys(redisClient, conf.WarmupPattern)
+	} else {
+		return
+	}
+
+	budget := time.Duration(conf.WarmupBudget) * time.Millisecond
+	warmed, err := p.Warm(keys, budget)
+	if err != nil {
+		log.Println("Warm-up:", err)
+	}
+
+	fmt.Println("Warmed up", warmed, "cached keys")
+}
+
+// shutdownOnSignal stops the server gracefully on SIGINT or SIGTERM, letting
+// in-flight requests finish first
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWNTIMEOUT)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Shutdown:", err)
+	}
+}
+
+// snapshotEvery saves a snapshot of c every interval, so a crash loses at most
+// one interval's worth of cached keys
+func snapshotEvery(c cache.Cache, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := cache.SaveSnapshot(c, path)
+		if err != nil {
+			log.Println("Snapshot:", err)
+		}
+	}
 }
 
 func getConfig() *config.Config {
@@ -49,11 +170,77 @@ func getConfig() *config.Config {
 	return conf
 }
 
-func connectRedis(address string) (*redis.Client, string) {
+func newCache(conf *config.Config) (cache.Cache, error) {
+	// stale entries are kept for as long as either can serve them
+	staleWindow := conf.StaleWhileRevalidate
+	if conf.MaxStale > staleWindow {
+		staleWindow = conf.MaxStale
+	}
+
+	opts := []cache.Option{
+		cache.WithPolicy(conf.CachePolicy),
+		cache.WithMaxBytes(conf.CacheMaxBytes),
+		cache.WithStaleWindow(time.Duration(staleWindow) * time.Millisecond),
+		cache.WithCompression(conf.CacheCompression, conf.CacheCompressThreshold),
+		cache.WithJitter(conf.CacheJitter),
+	}
+
+	if conf.CacheSweepInterval > 0 {
+		sweepInterval := time.Duration(conf.CacheSweepInterval) * time.Millisecond
+		opts = append(opts, cache.WithJanitor(sweepInterval, conf.CacheSweepSample))
+	}
+
+	if conf.DiskDir != "" {
+		disk, err := cache.NewDisk(conf.DiskDir, conf.DiskExpiry, conf.DiskMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return cache.NewTiered(conf.CacheExpiry, conf.CacheCapacity, conf.CacheShards, disk, opts...)
+	}
+
+	if conf.CacheShards > 1 {
+		return cache.NewSharded(conf.CacheExpiry, conf.CacheCapacity, conf.CacheShards, opts...)
+	}
+
+	return cache.NewMemory(conf.CacheExpiry, conf.CacheCapacity, opts...)
+}
+
+func proxyOptions(conf *config.Config) ([]proxy.Option, error) {
+	opts := []proxy.Option{
+		proxy.WithEarlyRefresh(conf.EarlyRefreshBeta),
+		proxy.WithStaleWhileRevalidate(time.Duration(conf.StaleWhileRevalidate) * time.Millisecond),
+		proxy.WithMaxStale(time.Duration(conf.MaxStale) * time.Millisecond),
+		proxy.WithTimeout(time.Duration(conf.RedisTimeout) * time.Millisecond),
+	}
+
+	if conf.DisableCacheHeaders {
+		opts = append(opts, proxy.WithoutCacheHeaders())
+	}
+
+	if conf.NegativeCacheExpiry > 0 {
+		capacity := conf.NegativeCacheCapacity
+		if capacity == 0 {
+			capacity = conf.CacheCapacity
+		}
+
+		negativeCache, err := cache.NewMemory(conf.NegativeCacheExpiry, capacity, cache.WithMaxBytes(conf.CacheMaxBytes))
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, proxy.WithNegativeCache(negativeCache))
+	}
+
+	return opts, nil
+}
+
+func connectRedis(address string, readTimeout time.Duration) (*redis.Client, string) {
 	client := redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: "",
-		DB:       0,
+		Addr:        address,
+		Password:    "",
+		DB:          0,
+		ReadTimeout: readTimeout,
 	})
 
 	pong, err := client.Ping().Result()
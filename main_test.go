@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,7 +30,7 @@ import (
 var redisClient *redis.Client
 var conf *config.Config
 var basePath string
-var lru *cache.LRU
+var lru *cache.Memory
 
 func TestProxyStartup(t *testing.T) {
 	os.Setenv("CACHEEXPIRY", "50")
@@ -30,7 +40,7 @@ func TestProxyStartup(t *testing.T) {
 	basePath = fmt.Sprintf("http://localhost:%v/", conf.ProxyPort)
 
 	var pong string
-	redisClient, pong = connectRedis(conf.RedisAddress)
+	redisClient, pong = connectRedis(conf.RedisAddress, time.Duration(conf.RedisReadTimeout)*time.Millisecond)
 	if pong != "PONG" {
 		t.Error("No pong")
 	}
@@ -43,7 +53,31 @@ func TestProxyStartup(t *testing.T) {
 
 	http.HandleFunc("/", proxy.RedisProxyHandler(redisClient, lru))
 	portString := fmt.Sprintf(":%v", conf.ProxyPort)
-	go http.ListenAndServe(portString, nil)
+
+	// listen before returning, so later tests don't race the server startup
+	listener, err := net.Listen("tcp", portString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, nil)
+}
+
+func TestConfigBreakerFailureRate(t *testing.T) {
+	defer os.Unsetenv("BREAKERFAILURERATE")
+
+	for _, rate := range []string{"-0.5", "1.5", "NaN"} {
+		os.Setenv("BREAKERFAILURERATE", rate)
+		if _, err := config.LoadConfig(CONFIGFILE); err != config.ErrInvalidBreakerFailureRate {
+			t.Error("Out of range failure rate accepted", rate, err)
+		}
+	}
+
+	for _, rate := range []string{"0", "0.5", "1"} {
+		os.Setenv("BREAKERFAILURERATE", rate)
+		if _, err := config.LoadConfig(CONFIGFILE); err != nil {
+			t.Error("Failure rate rejected", rate, err)
+		}
+	}
 }
 
 func TestRedisKeys(t *testing.T) {
@@ -155,74 +189,1345 @@ func TestProxyCacheUpdate(t *testing.T) {
 	}
 }
 
-func TestConcurrentClients(t *testing.T) {
+func TestProxyRedisTTL(t *testing.T) {
 	testSetup(t)
 
-	pairs := map[string]string{
-		"KEY1": "VAL1",
-		"KEY2": "VAL2",
-		"KEY3": "VAL3",
-		"KEY4": "VAL4",
-		"KEY5": "VAL5",
+	redisClient.Set("KEY1", "VAL1", 20*time.Millisecond)
+
+	body, err := requestBody("KEY1")
+	if err != nil {
+		t.Error(err)
+	}
+	if body != "VAL1" {
+		t.Error("Initial value mismatch")
 	}
 
-	for key, val := range pairs {
-		redisClient.Set(key, val, time.Hour)
+	// expired in Redis, but not yet by the global cache expiry
+	time.Sleep(time.Duration(30) * time.Millisecond)
+
+	resp, err := http.Get(basePath + "KEY1")
+	if err != nil {
+		t.Fatal(err)
 	}
+	resp.Body.Close()
 
-	var wg sync.WaitGroup
-	testRequest := func(key string, val string, sleepTime int) {
-		defer wg.Done()
-		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+	if resp.StatusCode != 404 {
+		t.Error("Key served past its Redis TTL")
+	}
+}
 
-		resp, err := http.Get(basePath + key)
+func TestProxyStaleWhileRevalidate(t *testing.T) {
+	testSetup(t)
+
+	staleCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity, cache.WithStaleWindow(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(proxy.RedisProxyHandler(redisClient, staleCache)))
+	defer server.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+
+	resp, err := http.Get(server.URL + "/KEY1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	redisClient.Set("KEY1", "VAL2", time.Hour)
+	time.Sleep(time.Duration(conf.CacheExpiry+10) * time.Millisecond)
+
+	// expired, so the stale value is served while it's refreshed
+	resp, err = http.Get(server.URL + "/KEY1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyByte, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(bodyByte) != "VAL1" ||
+		resp.Header.Get("X-Cache") != "STALE" ||
+		resp.Header.Get("Warning") == "" {
+
+		t.Error("Stale value not served as stale")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err = http.Get(server.URL + "/KEY1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyByte, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(bodyByte) != "VAL2" || resp.Header.Get("X-Cache") == "STALE" {
+		t.Error("Stale value not refreshed")
+	}
+}
+
+func TestProxyNegativeCache(t *testing.T) {
+	testSetup(t)
+
+	negativeCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithNegativeCache(negativeCache))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	status := func() int {
+		resp, err := http.Get(server.URL + "/KEY1")
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
+		resp.Body.Close()
 
-		bodyByte, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	if status() != 404 || negativeCache.Len() != 1 {
+		t.Error("Miss not remembered")
+	}
+
+	// the miss is served from memory until it expires
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+	if status() != 404 {
+		t.Error("Remembered miss not served")
+	}
+
+	time.Sleep(time.Duration(conf.CacheExpiry+10) * time.Millisecond)
+
+	if status() != 200 || lru.Len() != 1 {
+		t.Error("Expired miss still served")
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	testSetup(t)
+
+	counters := &proxy.Counters{}
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithCounters(counters))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	statsServer := httptest.NewServer(http.HandlerFunc(proxy.StatsHandler(lru, counters)))
+	defer statsServer.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+	for _, key := range []string{"KEY1", "KEY1", "KEY2"} {
+		resp, err := http.Get(server.URL + "/" + key)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
+		resp.Body.Close()
+	}
 
-		err = resp.Body.Close()
+	expected := proxy.Stats{
+		CacheHits:   1,
+		CacheMisses: 2,
+		RedisHits:   1,
+		RedisMisses: 1,
+	}
+
+	if stats := counters.Stats(); stats != expected {
+		t.Error("Unexpected proxy stats", stats)
+	}
+
+	resp, err := http.Get(statsServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var stats struct {
+		Proxy proxy.Stats
+		Cache cache.Stats
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Proxy != expected || stats.Cache.Hits != 1 || stats.Cache.Sets != 1 {
+		t.Error("Unexpected served stats", stats)
+	}
+
+	counters.Reset()
+	if counters.Stats() != (proxy.Stats{}) {
+		t.Error("Stats not reset")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	testSetup(t)
+
+	redisClient.Set("WARM1", "VAL1", time.Hour)
+	redisClient.Set("WARM2", "VAL2", 0)
+	redisClient.Set("COLD1", "VAL3", time.Hour)
+
+	warm, err := cache.NewLRU(int(time.Hour/time.Millisecond), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warmed, err := proxy.Warm(redisClient, warm, proxy.ScanKeys(redisClient, "WARM*"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warmed != 2 ||
+		warm.Peek("WARM1") == nil ||
+		warm.Peek("WARM2") == nil ||
+		warm.Peek("COLD1") != nil {
+
+		t.Error("Scanned keys not warmed", warmed)
+	}
+
+	if warm.Peek("WARM1").TTL == 0 || warm.Peek("WARM2").TTL != 0 {
+		t.Error("Redis TTLs not warmed")
+	}
+
+	// missing keys are skipped
+	warm.Clear()
+	keyFile := strings.NewReader("COLD1\n\nMISSING\nWARM1\n")
+
+	warmed, err = proxy.Warm(redisClient, warm, proxy.ReaderKeys(keyFile), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warmed != 2 || !reflect.DeepEqual(warm.Keys(), []string{"WARM1", "COLD1"}) {
+		t.Error("Listed keys not warmed", warm.Keys())
+	}
+}
+
+func TestWarmupStopsWhenFull(t *testing.T) {
+	testSetup(t)
+
+	var keys []string
+	for i := 0; i < 3*proxy.WARMUP_BATCH; i++ {
+		key := fmt.Sprintf("KEY%v", i)
+		redisClient.Set(key, "VAL", time.Hour)
+		keys = append(keys, key)
+	}
+
+	warm, err := cache.NewLRU(int(time.Hour/time.Millisecond), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cached keys are kept, and take up room
+	warm.Set("KEY0", []byte("CACHED"))
+
+	keyFile := strings.NewReader(strings.Join(keys, "\n"))
+	warmed, err := proxy.Warm(redisClient, warm, proxy.ReaderKeys(keyFile), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warmed != 9 || warm.Len() != 10 || warm.Stats().Evictions != 0 {
+		t.Error("Warm-up didn't stop when full", warmed, warm.Len())
+	}
+
+	if string(warm.Peek("KEY0").Value) != "CACHED" {
+		t.Error("Warm-up replaced a cached key")
+	}
+
+	// caches bounded by bytes fill until a batch doesn't fit
+	warm, err = cache.NewLRU(int(time.Hour/time.Millisecond), 0, cache.WithMaxBytes(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile = strings.NewReader(strings.Join(keys, "\n"))
+	warmed, err = proxy.Warm(redisClient, warm, proxy.ReaderKeys(keyFile), 0)
+	if err != nil || warmed == 0 || warmed == len(keys) || warmed != warm.Len() {
+		t.Error("Warm-up didn't stop at the byte limit", warmed, warm.Len())
+	}
+
+	// a spent budget stops warm-up before fetching anything
+	warm.Clear()
+	warmed, err = proxy.Warm(redisClient, warm, proxy.ReaderKeys(strings.NewReader("KEY1")), time.Nanosecond)
+	if err != nil || warmed != 0 {
+		t.Error("Warm-up overran its budget", warmed)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	readiness := &proxy.Readiness{}
+	server := httptest.NewServer(http.HandlerFunc(proxy.ReadyHandler(readiness)))
+	defer server.Close()
+
+	status := func() int {
+		resp, err := http.Get(server.URL)
 		if err != nil {
-			t.Error(err)
+			t.Fatal(err)
 		}
+		resp.Body.Close()
 
-		if string(bodyByte) != val {
-			t.Error("Value mismatch", bodyByte, val)
-		}
+		return resp.StatusCode
 	}
 
-	for i := 0; i < 100; i++ {
-		for key, val := range pairs {
-			wg.Add(1)
-			go testRequest(key, val, rand.Intn(10))
+	if status() != 503 {
+		t.Error("Ready before warm-up")
+	}
+
+	readiness.SetReady()
+	if status() != 200 {
+		t.Error("Not ready after warm-up")
+	}
+}
+
+func TestProxyTiers(t *testing.T) {
+	testSetup(t)
+
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := cache.NewDisk(dir, conf.CacheExpiry, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiered, err := cache.NewTiered(conf.CacheExpiry, 1, 1, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiered.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(proxy.RedisProxyHandler(redisClient, tiered)))
+	defer server.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+	redisClient.Set("KEY2", "VAL2", time.Hour)
+
+	tier := func(key string) string {
+		resp, err := http.Get(server.URL + "/" + key)
+		if err != nil {
+			t.Fatal(err)
 		}
+		resp.Body.Close()
+
+		return resp.Header.Get("X-Cache-Tier")
 	}
 
-	wg.Wait()
+	// KEY1 is demoted to disk by KEY2, then promoted back to memory
+	if tier("KEY1") != "redis" ||
+		tier("KEY1") != "memory" ||
+		tier("KEY2") != "redis" {
+
+		t.Error("Serving tier misreported")
+	}
+
+	// demotions are written in the background
+	for start := time.Now(); disk.Len() == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	if tier("KEY1") != "disk" || tier("KEY1") != "memory" {
+		t.Error("Demoted tier misreported")
+	}
 }
 
-// utility functions
-func requestBody(path string) (body string, err error) {
-	resp, err := http.Get(basePath + path)
+func TestProxyCompression(t *testing.T) {
+	testSetup(t)
+
+	compressed, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity, cache.WithCompression(cache.CodecGzip, 10))
 	if err != nil {
-		return "", err
+		t.Fatal(err)
 	}
 
-	defer resp.Body.Close()
-	bodyByte, err := ioutil.ReadAll(resp.Body)
+	server := httptest.NewServer(http.HandlerFunc(proxy.RedisProxyHandler(redisClient, compressed)))
+	defer server.Close()
+
+	value := strings.Repeat("VAL1", 100)
+	redisClient.Set("KEY1", value, time.Hour)
+
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", server.URL+"/KEY1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, body
+	}
+
+	// fetched from Redis, then compressed in the cache, and served from the
+	// cached entry from the start
+	if _, body := get(""); string(body) != value {
+		t.Error("Initial value mismatch")
+	}
+
+	resp, body := get("deflate, gzip;q=0.5")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("Stored gzip not served")
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		t.Fatal(err)
 	}
 
-	return string(bodyByte), nil
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil || string(decompressed) != value {
+		t.Error("Served gzip value mismatch")
+	}
+
+	// the gzipped and decompressed values are different representations, with
+	// their own ETags
+	gzipETag := resp.Header.Get("ETag")
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0", "*;q=1, gzip;q=0"} {
+		resp, body = get(acceptEncoding)
+		if resp.Header.Get("Content-Encoding") != "" || string(body) != value {
+			t.Error("Decompressed value not served for", acceptEncoding)
+		}
+
+		if etag := resp.Header.Get("ETag"); etag == "" || etag == gzipETag {
+			t.Error("Decompressed value served with the gzip ETag", acceptEncoding)
+		}
+	}
+}
+
+func TestProxyEarlyRefresh(t *testing.T) {
+	testSetup(t)
+
+	counters := &proxy.Counters{}
+
+	// a huge beta refreshes on every hit
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithEarlyRefresh(1e9), proxy.WithCounters(counters))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+
+	get := func() (string, string) {
+		resp, err := http.Get(server.URL + "/KEY1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(body), resp.Header.Get("X-Cache")
+	}
+
+	get()
+	redisClient.Set("KEY1", "VAL2", time.Hour)
+
+	// still fresh, so served from the cache while it's refreshed
+	if body, xCache := get(); body != "VAL1" || xCache == "STALE" {
+		t.Error("Early refresh not served from the cache")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if body, _ := get(); body != "VAL2" || counters.Stats().EarlyRefreshes == 0 {
+		t.Error("Value not refreshed early")
+	}
+}
+
+func TestProxyTypes(t *testing.T) {
+	testSetup(t)
+
+	redisClient.Set("STRING", "VAL1", time.Hour)
+	redisClient.HSet("HASH", "a", "1")
+	redisClient.HSet("HASH", "b", "2")
+	redisClient.RPush("LIST", "a", "b", "c")
+	redisClient.SAdd("SET", "b", "a")
+	redisClient.ZAdd("ZSET", redis.Z{Score: 2, Member: "b"}, redis.Z{Score: 1, Member: "a"})
+
+	get := func(path string) (status int, body string, contentType string, tier string) {
+		resp, err := http.Get(basePath + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, string(bodyBytes), resp.Header.Get("Content-Type"), resp.Header.Get("X-Cache-Tier")
+	}
+
+	cases := []struct {
+		path string
+		body string
+	}{
+		{"HASH", `{"a":"1","b":"2"}`},
+		{"HASH/b", `"2"`},
+		{"LIST", `["a","b","c"]`},
+		{"LIST?start=1&stop=-1", `["b","c"]`},
+		{"SET", `["a","b"]`},
+		{"ZSET", `[{"member":"a","score":1},{"member":"b","score":2}]`},
+		{"ZSET?start=-1", `[{"member":"b","score":2}]`},
+	}
+
+	for _, c := range cases {
+		// fetched from Redis, then served from the cache in the same shape
+		for _, expectedTier := range []string{proxy.TIER_REDIS, cache.TierMemory} {
+			status, body, contentType, tier := get(c.path)
+			if status != 200 || body != c.body || contentType != proxy.JSON_CONTENT_TYPE || tier != expectedTier {
+				t.Error("Unexpected typed response", c.path, status, body, contentType, tier)
+			}
+		}
+	}
+
+	if _, body, contentType, _ := get("STRING"); body != "VAL1" || contentType == proxy.JSON_CONTENT_TYPE {
+		t.Error("String not served as stored", body, contentType)
+	}
+
+	for _, path := range []string{"HASH/c", "STRING/a", "MISSING/a"} {
+		if status, _, _, _ := get(path); status != 404 {
+			t.Error("Missing field found", path, status)
+		}
+	}
+
+	// a string named like a range read of LIST is a different key
+	redisClient.Set("LIST?start=1&stop=-1", "VAL2", time.Hour)
+	if _, body, _, _ := get(url.PathEscape("LIST?start=1&stop=-1")); body != "VAL2" {
+		t.Error("Range read served for a key", body)
+	}
+
+	if status, body, _, _ := get("LIST?start=a"); status != 400 || !strings.Contains(body, `"code":"invalid_range"`) {
+		t.Error("Invalid range accepted", status, body)
+	}
+}
+
+func TestProxyConditional(t *testing.T) {
+	testSetup(t)
+
+	// a cache that keeps values long enough for a max-age
+	c, err := cache.NewLRU(10000, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.RedisProxyHandler(redisClient, c)
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	get := func(path string, ifNoneMatch string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, string(body)
+	}
+
+	redisClient.Set("KEY1", "VAL1", 0)
+	redisClient.Set("KEY2", "VAL2", 3*time.Second)
+
+	resp, body := get("/KEY1", "")
+	etag := resp.Header.Get("ETag")
+	if body != "VAL1" || !strings.HasPrefix(etag, `"`) ||
+		resp.Header.Get("Cache-Control") != "max-age=10" || resp.Header.Get("Age") != "0" {
+
+		t.Error("Unexpected caching headers", resp.Header)
+	}
+
+	// the ETag is the same once the value is served from the cache
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp, body = get("/KEY1", ifNoneMatch)
+		if resp.StatusCode != 304 || body != "" || resp.Header.Get("ETag") != etag {
+			t.Error("Current copy not answered with a 304", ifNoneMatch, resp.StatusCode)
+		}
+	}
+
+	if resp, body = get("/KEY1", `"other"`); resp.StatusCode != 200 || body != "VAL1" {
+		t.Error("Outdated copy not answered with the value", resp.StatusCode)
+	}
+
+	// values expiring sooner in Redis are kept for less time, which PTTL gives
+	// as just under 3s
+	resp, _ = get("/KEY2", "")
+	if cacheControl := resp.Header.Get("Cache-Control"); (cacheControl != "max-age=2" && cacheControl != "max-age=3") || resp.Header.Get("ETag") == etag {
+		t.Error("Unexpected caching headers for a Redis TTL", resp.Header)
+	}
+}
+
+func TestProxyCacheHeaders(t *testing.T) {
+	testSetup(t)
+
+	negativeCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithNegativeCache(negativeCache))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	hidden := proxy.RedisProxyHandler(redisClient, lru, proxy.WithoutCacheHeaders())
+	hiddenServer := httptest.NewServer(http.HandlerFunc(hidden))
+	defer hiddenServer.Close()
+
+	get := func(url string) http.Header {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.Header
+	}
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+
+	header := get(server.URL + "/KEY1")
+	if header.Get("X-Cache") != proxy.CACHE_MISS || header.Get("X-Cache-Tier") != proxy.TIER_REDIS ||
+		header.Get("X-Cache-Age") != "0" || header.Get("X-Redis-Time") == "" {
+
+		t.Error("Unexpected miss headers", header)
+	}
+
+	header = get(server.URL + "/KEY1")
+	ttl, err := strconv.Atoi(header.Get("X-Cache-TTL"))
+	if header.Get("X-Cache") != proxy.CACHE_HIT || header.Get("X-Cache-Tier") != cache.TierMemory ||
+		err != nil || ttl <= 0 || ttl > conf.CacheExpiry || header.Get("X-Redis-Time") != "" {
+
+		t.Error("Unexpected hit headers", header)
+	}
+
+	if header = get(server.URL + "/KEY2"); header.Get("X-Cache") != proxy.CACHE_MISS {
+		t.Error("Unexpected missing key headers", header)
+	}
+
+	if header = get(server.URL + "/KEY2"); header.Get("X-Cache") != proxy.CACHE_NEGATIVE {
+		t.Error("Unexpected negative hit headers", header)
+	}
+
+	for _, key := range []string{"KEY1", "KEY3"} {
+		header = get(hiddenServer.URL + "/" + key)
+		if header.Get("X-Cache") != "" || header.Get("X-Cache-TTL") != "" {
+			t.Error("Cache headers not turned off", header)
+		}
+	}
+
+	// the tier isn't a diagnostic header, so it's still sent for values
+	if header = get(hiddenServer.URL + "/KEY1"); header.Get("X-Cache-Tier") != cache.TierMemory {
+		t.Error("Tier header turned off", header)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	testSetup(t)
+
+	get := func(client *redis.Client, path string, accept string) (*http.Response, string) {
+		server := httptest.NewServer(http.HandlerFunc(proxy.RedisProxyHandler(client, lru)))
+		defer server.Close()
+
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, string(body)
+	}
+
+	// nothing listens on port 1
+	unavailable := redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	defer unavailable.Close()
+
+	timingOut := slowRedis(50*time.Millisecond, redis.Options{WriteTimeout: 10 * time.Millisecond})
+	defer timingOut.Close()
+
+	cases := []struct {
+		client *redis.Client
+		path   string
+		status int
+		code   string
+	}{
+		{redisClient, "/KEY1", 404, "key_not_found"},
+		{redisClient, "/", 400, "key_empty"},
+		{unavailable, "/KEY1", 503, proxy.CODE_BACKEND_UNAVAILABLE},
+		{timingOut, "/KEY1", 504, proxy.CODE_BACKEND_TIMEOUT},
+	}
+
+	for _, c := range cases {
+		for _, accept := range []string{"", "application/json", "text/html, */*;q=0.1"} {
+			resp, body := get(c.client, c.path, accept)
+
+			var proxyErr proxy.Error
+			err := json.Unmarshal([]byte(body), &proxyErr)
+			if resp.StatusCode != c.status || resp.Header.Get("Content-Type") != proxy.JSON_CONTENT_TYPE ||
+				err != nil || proxyErr.Code != c.code || proxyErr.Message == "" {
+
+				t.Error("Unexpected error response", c.path, accept, resp.StatusCode, body)
+			}
+		}
+
+		// clients that don't take JSON get the message as plain text
+		resp, body := get(c.client, c.path, "text/plain")
+		if resp.StatusCode != c.status || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") ||
+			strings.Contains(body, c.code) || body == "" {
+
+			t.Error("Unexpected plain text error response", c.path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestProxyBreaker(t *testing.T) {
+	testSetup(t)
+
+	staleCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity, cache.WithStaleWindow(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleCache.SetWithTTL("KEY1", []byte("VAL1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// nothing listens on port 1
+	unavailable := redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	defer unavailable.Close()
+
+	breaker := proxy.NewBreaker(0.5, 2, time.Minute, 50*time.Millisecond)
+	counters := &proxy.Counters{}
+	newServer := func(client *redis.Client) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(proxy.RedisProxyHandler(client, staleCache,
+			proxy.WithBreaker(breaker), proxy.WithCounters(counters),
+			proxy.WithStaleWhileRevalidate(0), proxy.WithMaxStale(time.Minute))))
+	}
+
+	down := newServer(unavailable)
+	defer down.Close()
+	up := newServer(redisClient)
+	defer up.Close()
+
+	get := func(server *httptest.Server, path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, string(body)
+	}
+
+	code := func(body string) string {
+		var proxyErr proxy.Error
+		json.Unmarshal([]byte(body), &proxyErr)
+		return proxyErr.Code
+	}
+
+	// enough failures open the breaker
+	for _, path := range []string{"/MISSING1", "/MISSING2"} {
+		resp, body := get(down, path)
+		if resp.StatusCode != 503 || code(body) != proxy.CODE_BACKEND_UNAVAILABLE {
+			t.Error("Unexpected response from unavailable Redis", path, resp.StatusCode, body)
+		}
+	}
+
+	if breaker.State() != proxy.BreakerOpen {
+		t.Fatal("Breaker not opened by failures", breaker.State())
+	}
+
+	// so requests fail straight away
+	resp, body := get(down, "/MISSING3")
+	if resp.StatusCode != 503 || code(body) != "circuit_open" {
+		t.Error("Open breaker didn't fail fast", resp.StatusCode, body)
+	}
+
+	// unless there's a stale value to serve, which isn't a hit until it's
+	// served
+	hits := staleCache.Stats().Hits
+	resp, body = get(down, "/KEY1")
+	if resp.StatusCode != 200 || body != "VAL1" || resp.Header.Get("X-Cache") != proxy.CACHE_STALE ||
+		resp.Header.Get("Warning") != proxy.REVALIDATION_FAILED_WARNING {
+
+		t.Error("Stale value not served while the breaker is open", resp.StatusCode, body, resp.Header)
+	}
+
+	if counters.Stats().StaleFallbacks != 1 {
+		t.Error("Stale fallback not counted", counters.Stats().StaleFallbacks)
+	}
+
+	if staleCache.Stats().Hits != hits {
+		t.Error("Stale fallback lookup counted as a cache hit", staleCache.Stats())
+	}
+
+	// a failed probe after the cooldown reopens it
+	time.Sleep(60 * time.Millisecond)
+	get(down, "/MISSING1")
+	if status := breaker.Status(); status.State != "open" || status.Trips != 2 {
+		t.Error("Breaker not reopened by a failed probe", status)
+	}
+
+	// and a successful one closes it
+	time.Sleep(60 * time.Millisecond)
+	redisClient.Set("KEY1", "VAL2", time.Hour)
+	resp, body = get(up, "/KEY1")
+	if resp.StatusCode != 200 || body != "VAL2" || breaker.State() != proxy.BreakerClosed {
+		t.Error("Breaker not closed by a successful probe", resp.StatusCode, body, breaker.State())
+	}
+
+	statusServer := httptest.NewServer(http.HandlerFunc(proxy.BreakerHandler(breaker)))
+	defer statusServer.Close()
+
+	resp, body = get(statusServer, "")
+	var status proxy.BreakerStatus
+	err = json.Unmarshal([]byte(body), &status)
+	if err != nil || status.State != "closed" || status.Trips != 2 {
+		t.Error("Unexpected breaker status", body)
+	}
+}
+
+func TestProxyDeadlines(t *testing.T) {
+	testSetup(t)
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+
+	slow := slowRedis(100*time.Millisecond, redis.Options{})
+	defer slow.Close()
+
+	newServer := func(timeout time.Duration) (*httptest.Server, *cache.Memory) {
+		// long enough not to expire during the test
+		c, err := cache.NewLRU(10000, conf.CacheCapacity)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := proxy.RedisProxyHandler(slow, c, proxy.WithTimeout(timeout))
+		return httptest.NewServer(http.HandlerFunc(handler)), c
+	}
+
+	// a request that runs out of time is answered straight away
+	timingOut, timedOutCache := newServer(20 * time.Millisecond)
+	defer timingOut.Close()
+
+	start := time.Now()
+	resp, err := http.Get(timingOut.URL + "/KEY1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 504 || time.Since(start) >= 100*time.Millisecond {
+		t.Error("Request not answered at its deadline", resp.StatusCode, time.Since(start))
+	}
+
+	// a client that goes away doesn't stop the value being cached
+	patient, patientCache := newServer(time.Second)
+	defer patient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", patient.URL+"/KEY1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err == nil {
+		t.Error("Request not cancelled")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if entry := patientCache.Get("KEY1"); entry == nil || string(entry.Value) != "VAL1" {
+		t.Error("Value not cached after the client went away", entry)
+	}
+
+	// unless it arrives after the deadline
+	if timedOutCache.Get("KEY1") != nil {
+		t.Error("Value cached after the deadline")
+	}
+}
+
+func TestProxyWrites(t *testing.T) {
+	testSetup(t)
+
+	negativeCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithNegativeCache(negativeCache))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	do := func(method string, path string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, string(respBody)
+	}
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+	do("GET", "/KEY1", "")
+
+	// writes go through to Redis, and replace the cached value
+	if resp, _ := do("PUT", "/KEY1?ttl=1000", "VAL2"); resp.StatusCode != 204 {
+		t.Error("Unexpected PUT status", resp.StatusCode)
+	}
+
+	if val, _ := redisClient.Get("KEY1").Result(); val != "VAL2" {
+		t.Error("PUT not written to Redis", val)
+	}
+
+	if ttl := redisClient.PTTL("KEY1").Val(); ttl <= 0 || ttl > time.Second {
+		t.Error("PUT TTL not set in Redis", ttl)
+	}
+
+	if resp, body := do("GET", "/KEY1", ""); body != "VAL2" || resp.Header.Get("X-Cache-Tier") != cache.TierMemory {
+		t.Error("PUT not cached", body)
+	}
+
+	if resp, body := do("PUT", "/KEY1?ttl=a", "VAL3"); resp.StatusCode != 400 || !strings.Contains(body, `"code":"invalid_ttl"`) {
+		t.Error("Invalid TTL accepted", resp.StatusCode)
+	}
+
+	// deletes are removed from Redis and the cache
+	if resp, _ := do("DELETE", "/KEY1", ""); resp.StatusCode != 204 {
+		t.Error("Unexpected DELETE status", resp.StatusCode)
+	}
+
+	if redisClient.Get("KEY1").Err() != redis.Nil || lru.Get("KEY1") != nil {
+		t.Error("DELETE not written through")
+	}
+
+	if resp, _ := do("GET", "/KEY1", ""); resp.StatusCode != 404 {
+		t.Error("Deleted key served", resp.StatusCode)
+	}
+
+	if resp, _ := do("DELETE", "/KEY1", ""); resp.StatusCode != 404 {
+		t.Error("Missing key deleted", resp.StatusCode)
+	}
+
+	// a PUT replaces a remembered miss
+	do("PUT", "/KEY1", "VAL4")
+	if resp, body := do("GET", "/KEY1", ""); resp.StatusCode != 200 || body != "VAL4" {
+		t.Error("PUT not served after a miss", resp.StatusCode, body)
+	}
+
+	// writes leave behind what was read from parts of the key
+	redisClient.HSet("HASH1", "a", "1")
+	do("GET", "/HASH1/a", "")
+	do("DELETE", "/HASH1", "")
+	if resp, _ := do("GET", "/HASH1/a", ""); resp.StatusCode != 404 {
+		t.Error("Field of a deleted hash served", resp.StatusCode)
+	}
+
+	// a key named like a field replaces the field's remembered miss
+	do("PUT", "/HASH1/a", "VAL6")
+	if _, body := do("GET", "/HASH1/a", ""); body != "VAL6" {
+		t.Error("Field served instead of a key", body)
+	}
+
+	resp, _ := do("POST", "/KEY1", "VAL5")
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != proxy.ALLOWED_METHODS {
+		t.Error("Unexpected method allowed", resp.StatusCode)
+	}
+}
+
+func TestProxyConcurrentWrites(t *testing.T) {
+	testSetup(t)
+
+	negativeCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := proxy.RedisProxyHandler(redisClient, lru, proxy.WithNegativeCache(negativeCache))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	do := func(method string, body string) {
+		req, err := http.NewRequest(method, server.URL+"/KEY1", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// however writes to a key interleave, the cache ends up agreeing with Redis
+	for round := 0; round < 50; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				if i%4 == 0 {
+					do("DELETE", "")
+				} else {
+					do("PUT", fmt.Sprintf("VAL%d", i))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		value, err := redisClient.Get("KEY1").Result()
+		entry := lru.Get("KEY1")
+
+		if err == redis.Nil {
+			if entry != nil {
+				t.Fatal("Deleted key left cached", string(entry.Value))
+			}
+		} else if (entry != nil && string(entry.Value) != value) || negativeCache.Get("KEY1") != nil {
+			t.Fatal("Cache disagrees with Redis", value)
+		}
+	}
+}
+
+func TestMGet(t *testing.T) {
+	testSetup(t)
+
+	negativeCache, err := cache.NewLRU(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters := &proxy.Counters{}
+	p := proxy.New(redisClient, lru, proxy.WithCounters(counters), proxy.WithNegativeCache(negativeCache))
+	server := httptest.NewServer(http.HandlerFunc(p.MGetHandler()))
+	defer server.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+	redisClient.Set("KEY2", "VAL2", time.Hour)
+	lru.Set("KEY1", []byte("CACHED1"))
+
+	mget := func(resp *http.Response, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != proxy.JSON_CONTENT_TYPE {
+			t.Error("Unexpected mget response", resp.StatusCode, string(body))
+		}
+
+		return string(body)
+	}
+
+	expected := `[{"key":"KEY1","found":true,"value":"CACHED1"},` +
+		`{"key":"KEY2","found":true,"value":"VAL2"},` +
+		`{"key":"KEY3","found":false},` +
+		`{"key":"KEY2","found":true,"value":"VAL2"}]`
+
+	body := mget(http.Get(server.URL + "?k=KEY1&k=KEY2&k=KEY3&k=KEY2"))
+	if body != expected {
+		t.Error("Unexpected mget results", body)
+	}
+
+	stats := counters.Stats()
+	if stats.CacheHits != 1 || stats.CacheMisses != 3 || stats.RedisHits != 1 || stats.RedisMisses != 1 {
+		t.Error("Unexpected mget stats", stats)
+	}
+
+	// fetched values are cached, and missing keys remembered
+	redisClient.Set("KEY2", "VAL3", time.Hour)
+
+	body = mget(http.Post(server.URL, "application/json", strings.NewReader(`["KEY2"]`)))
+	if body != `[{"key":"KEY2","found":true,"value":"VAL2"}]` {
+		t.Error("Fetched value not cached", body)
+	}
+
+	if negativeCache.Get("KEY3") == nil {
+		t.Error("Missing key not remembered")
+	}
+
+	// keys named like a hash field are fetched, but not cached, since
+	// writes to them only invalidate what's cached for their path
+	redisClient.Set("HASH2/a", "VAL4", time.Hour)
+
+	body = mget(http.Get(server.URL + "?k=HASH2/a"))
+	if body != `[{"key":"HASH2/a","found":true,"value":"VAL4"}]` || lru.Get("HASH2/a") != nil {
+		t.Error("Key named like a field cached", body)
+	}
+
+	// keys MGET can't read are loaded like single keys, whether they're
+	// cached yet or not
+	redisClient.HSet("HASH3", "a", "1")
+
+	expected = `[{"key":"HASH3","found":true,"value":{"a":"1"}},` +
+		`{"key":"HASH3/a","found":true,"value":"1"},` +
+		`{"key":"HASH3/b","found":false}]`
+
+	for i := 0; i < 2; i++ {
+		body = mget(http.Get(server.URL + "?k=HASH3&k=HASH3/a&k=HASH3/b"))
+		if body != expected {
+			t.Error("Unexpected mget results for a hash", i, body)
+		}
+	}
+
+	if entry := lru.Get("HASH3"); entry == nil || entry.ContentType != proxy.JSON_CONTENT_TYPE {
+		t.Error("Loaded hash not cached", entry)
+	}
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"k":"KEY1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 400 {
+		t.Error("Invalid mget body accepted", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest("PUT", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, POST" {
+		t.Error("Unexpected mget method allowed", resp.StatusCode)
+	}
+}
+
+func TestProxyCoalescing(t *testing.T) {
+	testSetup(t)
+
+	// a cache of its own, which no refresh from an earlier test can set
+	c, err := cache.NewMemory(conf.CacheExpiry, conf.CacheCapacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// slow enough that the other requests miss while the first one fetches
+	slowClient := slowRedis(50*time.Millisecond, redis.Options{})
+	defer slowClient.Close()
+
+	counters := &proxy.Counters{}
+	handler := proxy.RedisProxyHandler(slowClient, c, proxy.WithCounters(counters))
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	redisClient.Set("KEY1", "VAL1", time.Hour)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			resp, err := http.Get(server.URL + "/KEY1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil || string(body) != "VAL1" {
+				t.Error("Unexpected coalesced response", string(body), err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// every miss either fetched from Redis or shared a fetch in flight, and
+	// each fetch set the value once
+	stats := counters.Stats()
+	if stats.RedisHits+stats.Coalesced != stats.CacheMisses {
+		t.Error("Misses neither fetched nor coalesced", stats)
+	}
+
+	if stats.Coalesced == 0 {
+		t.Error("Concurrent misses not coalesced", stats)
+	}
+
+	if sets := c.Stats().Sets; sets != stats.RedisHits {
+		t.Error("Value set more than once per fetch", sets, stats)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	testSetup(t)
+
+	pairs := map[string]string{
+		"KEY1": "VAL1",
+		"KEY2": "VAL2",
+		"KEY3": "VAL3",
+		"KEY4": "VAL4",
+		"KEY5": "VAL5",
+	}
+
+	for key, val := range pairs {
+		redisClient.Set(key, val, time.Hour)
+	}
+
+	var wg sync.WaitGroup
+	testRequest := func(key string, val string, sleepTime int) {
+		defer wg.Done()
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+
+		resp, err := http.Get(basePath + key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		bodyByte, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = resp.Body.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(bodyByte) != val {
+			t.Error("Value mismatch", bodyByte, val)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		for key, val := range pairs {
+			wg.Add(1)
+			go testRequest(key, val, rand.Intn(10))
+		}
+	}
+
+	wg.Wait()
+}
+
+// utility functions
+func requestBody(path string) (body string, err error) {
+	resp, err := http.Get(basePath + path)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	bodyByte, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bodyByte), nil
+}
+
+// slowRedis connects to Redis like redisClient, with any other options, but
+// delays sending every command
+func slowRedis(delay time.Duration, opts redis.Options) *redis.Client {
+	opts.Addr = conf.RedisAddress
+	opts.Dialer = func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", conf.RedisAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		return &slowConn{Conn: conn, delay: delay}, nil
+	}
+
+	return redis.NewClient(&opts)
+}
+
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
 }
 
 func testSetup(t *testing.T) {
 	lru.Clear()
+	lru.ResetStats()
 
 	cmd := redisClient.FlushAll()
 	err := cmd.Err()
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BREAKER_PATH is where main serves BreakerHandler, shadowing any Redis key
+// named "_breaker"
+const BREAKER_PATH = "/_breaker"
+
+// Defaults for NewBreaker's settings
+const BREAKER_MIN_REQUESTS = 10
+const BREAKER_WINDOW = 10 * time.Second
+const BREAKER_COOLDOWN = 5 * time.Second
+
+const CIRCUIT_OPEN = "Error - Redis is unavailable, and the circuit breaker is open"
+
+var ErrCircuitOpen = &Error{Status: 503, Code: "circuit_open", Message: CIRCUIT_OPEN}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go to Redis
+	BreakerOpen                         // calls fail straight away
+	BreakerHalfOpen                     // one call goes to Redis, to see if it's back
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+
+	return "unknown"
+}
+
+// Breaker is a circuit breaker around calls to Redis. It opens once enough of
+// the calls in a window fail, so calls fail straight away instead of waiting
+// on an unavailable Redis. After a cooldown, it half-opens, letting one call
+// through as a probe, and closes again if the probe succeeds, or reopens if it
+// fails. Only failures to reach Redis count, not error replies
+type Breaker struct {
+	failureRate float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+
+	mutex       *sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	trips       int
+}
+
+// BreakerStatus is a snapshot of a Breaker, for BreakerHandler
+type BreakerStatus struct {
+	State    string    `json:"state"`
+	Requests int       `json:"requests"` // calls in the current window, while closed
+	Failures int       `json:"failures"` // failed calls in the current window, while closed
+	OpenedAt time.Time `json:"openedAt"` // when the breaker last opened, zero if it never has
+	Trips    int       `json:"trips"`    // how many times the breaker has opened
+}
+
+// NewBreaker creates a closed breaker that opens when at least failureRate
+// of the calls in a window fail, once there have been at least minRequests
+// calls in it, and half-opens after cooldown. failureRate is between 0 and 1,
+// and other settings of 0 use the defaults
+func NewBreaker(failureRate float64, minRequests int, window time.Duration, cooldown time.Duration) *Breaker {
+	if minRequests == 0 {
+		minRequests = BREAKER_MIN_REQUESTS
+	}
+
+	if window == 0 {
+		window = BREAKER_WINDOW
+	}
+
+	if cooldown == 0 {
+		cooldown = BREAKER_COOLDOWN
+	}
+
+	return &Breaker{
+		failureRate: failureRate,
+		minRequests: minRequests,
+		window:      window,
+		cooldown:    cooldown,
+		mutex:       &sync.Mutex{},
+		windowStart: time.Now(),
+	}
+}
+
+// call makes a call to Redis, unless the breaker is open, when it returns
+// ErrCircuitOpen instead. A nil breaker makes every call
+func (b *Breaker) call(redisCall func() error) error {
+	if b == nil {
+		return redisCall()
+	}
+
+	if !b.allow(time.Now()) {
+		return ErrCircuitOpen
+	}
+
+	err := redisCall()
+	b.record(unavailable(err), time.Now())
+
+	return err
+}
+
+// allow returns whether a call can go to Redis
+func (b *Breaker) allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		// only one probe at a time
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+		return true
+	}
+
+	return true
+}
+
+// record counts the result of a call allowed through
+func (b *Breaker) record(failed bool, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+		} else {
+			b.state = BreakerClosed
+			b.resetWindow(now)
+		}
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.resetWindow(now)
+		}
+
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.minRequests && float64(b.failures) >= b.failureRate*float64(b.requests) {
+			b.open(now)
+		}
+	}
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.trips++
+	b.resetWindow(now)
+}
+
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// State returns the breaker's state. An open breaker reports itself open until
+// a call half-opens it
+func (b *Breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) Status() BreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return BreakerStatus{
+		State:    b.state.String(),
+		Requests: b.requests,
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+		Trips:    b.trips,
+	}
+}
+
+// BreakerHandler serves a breaker's status as JSON
+func BreakerHandler(b *Breaker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(b.Status())
+		if errIf(err, &w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		w.WriteHeader(200)
+		w.Write(body)
+	}
+}
+
+// unavailable returns whether an error from a call to Redis means Redis
+// couldn't be reached, or didn't answer in time
+func unavailable(err error) bool {
+	proxyErr, ok := backendError(err).(*Error)
+	return ok && (proxyErr.Status == 503 || proxyErr.Status == 504)
+}
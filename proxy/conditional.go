@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+)
+
+// etagFor returns a strong ETag for an entry's value, served as it's stored
+// or decoded. A value served compressed has a different ETag than the same
+// value served decompressed
+func etagFor(entry *cache.Entry, decoded bool) string {
+	if !decoded {
+		return entry.ETag
+	}
+
+	return strings.TrimSuffix(entry.ETag, `"`) + `-decoded"`
+}
+
+// notModified returns whether a request's If-None-Match lists etag, or any
+// ETag with a wildcard. If-None-Match compares ETags weakly (RFC 7232), so
+// a weak ETag matches the strong ETag it was made from
+func notModified(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setFreshness sets Cache-Control and Age headers for an entry. max-age is
+// the entry's whole lifetime in the cache, and Age how much of it has passed,
+// so caches downstream keep the value for as long as the entry has left.
+// Both are in whole seconds, rounded down
+func setFreshness(w http.ResponseWriter, entry *cache.Entry, now time.Time) {
+	maxAge := entry.Expires.Sub(entry.Timestamp) / time.Second
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	age := now.Sub(entry.Timestamp) / time.Second
+	if age < 0 {
+		age = 0
+	}
+
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(maxAge), 10))
+	w.Header().Set("Age", strconv.FormatInt(int64(age), 10))
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+)
+
+// deadline returns ctx, limited to the total time a request can spend on
+// Redis, if there's a limit
+func (o *options) deadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, o.timeout)
+}
+
+// withContext makes a call to Redis, returning ctx's error instead if ctx is
+// done first. go-redis doesn't cancel calls itself, so the call carries on in
+// the background, and anything it sets must only be used if it returned first
+func withContext(ctx context.Context, redisCall func() error) error {
+	// contexts that can't be done don't need the goroutine
+	if ctx.Done() == nil {
+		return redisCall()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- redisCall()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
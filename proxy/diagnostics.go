@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+)
+
+// X-Cache headers, for how a request was served
+const CACHE_HIT = "HIT"
+const CACHE_MISS = "MISS"
+const CACHE_STALE = "STALE"
+const CACHE_NEGATIVE = "NEGATIVE"
+
+// setCacheHeaders sets X-Cache-Tier, saying where a value came from, as
+// cache.TierMemory, cache.TierDisk or TIER_REDIS, and diagnostic headers
+// saying how a request was served, unless they're turned off:
+//
+//	X-Cache       HIT, MISS, STALE or NEGATIVE
+//	X-Cache-Age   how long ago the value was cached, in ms
+//	X-Cache-TTL   how long the value has left in the cache, in ms, 0 once it's stale
+//	X-Redis-Time  how long fetching the value from Redis took, in ms, on misses
+//
+// 404s only get X-Cache, with a nil entry, since there's no value to describe
+func (o *options) setCacheHeaders(w http.ResponseWriter, xCache string, tier string, entry *cache.Entry) {
+	if entry != nil {
+		w.Header().Set("X-Cache-Tier", tier)
+	}
+
+	if o.hideCacheHeaders {
+		return
+	}
+
+	w.Header().Set("X-Cache", xCache)
+	if entry == nil {
+		return
+	}
+
+	now := time.Now()
+
+	ttl := entry.Expires.Sub(now)
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	w.Header().Set("X-Cache-Age", strconv.FormatInt(milliseconds(now.Sub(entry.Timestamp)), 10))
+	w.Header().Set("X-Cache-TTL", strconv.FormatInt(milliseconds(ttl), 10))
+
+	if xCache == CACHE_MISS {
+		w.Header().Set("X-Redis-Time", strconv.FormatFloat(entry.FetchTime.Seconds()*1000, 'f', 3, 64))
+	}
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
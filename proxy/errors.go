@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// Error is an error the proxy answers a request with. Code names the error
+// for clients to check, and never changes, while Message is for people
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+const METHOD_NOT_ALLOWED = "Error - method not allowed"
+
+// Errors answering bad requests, and keys Redis doesn't have
+var (
+	ErrImproperlyEncoded = &Error{Status: 400, Code: "improperly_encoded_path", Message: IMPROPERLY_ENCODED_PATH}
+	ErrKeyEmpty          = &Error{Status: 400, Code: "key_empty", Message: KEY_EMPTY}
+	ErrInvalidRange      = &Error{Status: 400, Code: "invalid_range", Message: INVALID_RANGE}
+	ErrInvalidTTL        = &Error{Status: 400, Code: "invalid_ttl", Message: INVALID_TTL}
+	ErrInvalidMGetBody   = &Error{Status: 400, Code: "invalid_body", Message: MGET_INVALID_BODY}
+	ErrKeyNotFound       = &Error{Status: 404, Code: "key_not_found", Message: KEY_NOT_FOUND}
+	ErrMethodNotAllowed  = &Error{Status: 405, Code: "method_not_allowed", Message: METHOD_NOT_ALLOWED}
+)
+
+// Codes of errors from Redis, and from the proxy itself
+const (
+	CODE_BACKEND_ERROR       = "backend_error"       // 502, Redis replied with an error, or a reply that couldn't be read
+	CODE_BACKEND_UNAVAILABLE = "backend_unavailable" // 503, Redis couldn't be reached, or can't serve requests right now
+	CODE_BACKEND_TIMEOUT     = "backend_timeout"     // 504, Redis didn't reply in time
+	CODE_WRONG_TYPE          = "wrong_type"          // 409, the key changed type while it was being read
+	CODE_UNSUPPORTED_TYPE    = "unsupported_type"    // 422, the key's type can't be served, like a stream
+	CODE_INTERNAL            = "internal_error"      // 500, anything else
+)
+
+// Error replies from Redis that mean it's up, but can't serve requests yet
+var unavailableReplies = []string{"LOADING ", "BUSY ", "MASTERDOWN ", "CLUSTERDOWN ", "TRYAGAIN ", "ERR max number of clients reached"}
+
+// backendError classifies an error from a call to Redis as an *Error, leaving
+// nil, redis.Nil and errors that are already an *Error as they are
+func backendError(err error) error {
+	if err == nil || err == redis.Nil {
+		return err
+	}
+
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+
+	if err == ErrUnsupportedType {
+		return &Error{Status: 422, Code: CODE_UNSUPPORTED_TYPE, Message: err.Error()}
+	}
+
+	message := err.Error()
+	if err == context.DeadlineExceeded {
+		return &Error{Status: 504, Code: CODE_BACKEND_TIMEOUT, Message: message}
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &Error{Status: 504, Code: CODE_BACKEND_TIMEOUT, Message: message}
+	}
+
+	// go-redis doesn't export its own error types, so they're known by name
+	switch {
+	case message == "redis: connection pool timeout":
+		return &Error{Status: 504, Code: CODE_BACKEND_TIMEOUT, Message: message}
+	case message == "redis: client is closed", err == io.EOF, err == io.ErrUnexpectedEOF:
+		return &Error{Status: 503, Code: CODE_BACKEND_UNAVAILABLE, Message: message}
+	case strings.HasPrefix(message, "WRONGTYPE "):
+		return &Error{Status: 409, Code: CODE_WRONG_TYPE, Message: message}
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return &Error{Status: 503, Code: CODE_BACKEND_UNAVAILABLE, Message: message}
+	}
+
+	for _, reply := range unavailableReplies {
+		if strings.HasPrefix(message, reply) {
+			return &Error{Status: 503, Code: CODE_BACKEND_UNAVAILABLE, Message: message}
+		}
+	}
+
+	return &Error{Status: 502, Code: CODE_BACKEND_ERROR, Message: message}
+}
+
+// errIf answers a request with err, if there is one. Errors that aren't an
+// *Error are the proxy's own, and answered with a 500
+func errIf(err error, w *http.ResponseWriter, r *http.Request) bool {
+	if err == nil {
+		return false
+	}
+
+	proxyErr, ok := err.(*Error)
+	if !ok {
+		proxyErr = &Error{Status: 500, Code: CODE_INTERNAL, Message: err.Error()}
+	}
+
+	writeError(*w, r, proxyErr)
+	return true
+}
+
+// writeError answers a request with err, as JSON, unless the client only
+// accepts other types, when it's sent as plain text
+func writeError(w http.ResponseWriter, r *http.Request, err *Error) {
+	// there's no one to answer once the client has gone away
+	if r.Context().Err() == context.Canceled {
+		return
+	}
+
+	if !acceptsJSON(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(err.Status)
+		w.Write([]byte(err.Message))
+		return
+	}
+
+	body, _ := json.Marshal(err)
+
+	w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+	w.WriteHeader(err.Status)
+	w.Write(body)
+}
+
+// acceptsJSON returns whether a request's Accept header allows JSON, which
+// it does if there's no Accept header at all
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return accept == "" || accepts(accept, "application/json", "application/*", "*/*")
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+	"github.com/go-redis/redis"
+)
+
+// GENERATIONS is how many generation counters the loader spreads keys over.
+// Keys that share a counter also share invalidations, which only costs them
+// the odd extra miss
+const GENERATIONS = 4096
+
+// WRITE_LOCKS is how many locks the loader spreads writes over. Writes to
+// keys that share a lock wait on each other
+const WRITE_LOCKS = 256
+
+// loader fetches keys from Redis into the cache, and writes them through to
+// Redis. Concurrent loads of the same key share one Redis call, and all get its
+// result. Every write bumps its key's generation, and loads only cache what
+// they read if the generations they depend on haven't changed since they
+// started, so they never overwrite a newer value. Writes to a key hold its
+// write lock from the Redis call until the cache is updated, so they reach
+// the cache in the order they reached Redis
+type loader struct {
+	redisClient *redis.Client
+	cache       cache.Cache
+	o           options
+	mutex       *sync.Mutex // only guards flights
+	flights     map[string]*flight
+	generations []uint64
+	writeLocks  []sync.Mutex
+}
+
+// flight is a load in progress, started at version, whose result is set
+// before done is closed
+type flight struct {
+	done    chan struct{}
+	version uint64
+	entry   *cache.Entry
+	err     error
+}
+
+func newLoader(redisClient *redis.Client, c cache.Cache, o options) *loader {
+	return &loader{
+		redisClient: redisClient,
+		cache:       c,
+		o:           o,
+		mutex:       &sync.Mutex{},
+		flights:     make(map[string]*flight),
+		generations: make([]uint64, GENERATIONS),
+		writeLocks:  make([]sync.Mutex, WRITE_LOCKS),
+	}
+}
+
+// load fetches a read's result from Redis and caches it, or waits for the same
+// read that's already in flight, returning the result's cache entry. Results
+// that weren't cached, because a write overtook them, are returned in an
+// entry that's already expired. Results missing from Redis are removed from
+// the cache, and remembered by any negative cache, with a redis.Nil error.
+// If ctx is done first, load returns its error, but the fetch carries on, and
+// its result is still cached if it arrives within the deadline
+func (l *loader) load(ctx context.Context, rd read) (*cache.Entry, error) {
+	version := l.version(rd)
+	key := rd.cacheKey(version)
+
+	l.mutex.Lock()
+	f, exists := l.flights[key]
+	if exists && f.version >= version {
+		atomic.AddUint64(&l.o.counters.coalesced, 1)
+	} else {
+		// a flight from before a write may read the old value, so loads
+		// after the write don't wait on it
+		f = &flight{done: make(chan struct{}), version: version}
+		l.flights[key] = f
+		go l.fly(key, rd, f)
+	}
+	l.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.entry, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fly fetches a flight's read from Redis and caches it. It isn't tied to any
+// one request, so requests giving up don't cancel it, only the deadline
+func (l *loader) fly(key string, rd read, f *flight) {
+	ctx, cancel := l.o.deadline(context.Background())
+	defer cancel()
+
+	var value []byte
+	var contentType string
+	var ttl time.Duration
+
+	start := time.Now()
+	err := withContext(ctx, func() error {
+		return l.o.breaker.call(func() (err error) {
+			value, contentType, ttl, err = fetch(l.redisClient.WithContext(ctx), rd)
+			return err
+		})
+	})
+	fetchTime := time.Since(start)
+
+	var entry *cache.Entry
+	cached := false
+	if err == redis.Nil {
+		atomic.AddUint64(&l.o.counters.redisMisses, 1)
+		l.forget(key, rd, f.version)
+	} else if err == nil {
+		atomic.AddUint64(&l.o.counters.redisHits, 1)
+		entry, cached = l.fill(rd, f.version, value, ttl, fetchTime, contentType)
+	}
+
+	// a write overtook the load, so what it read may already be out of date
+	if entry != nil && !cached {
+		entry.Expires = entry.Timestamp
+	}
+
+	l.mutex.Lock()
+	if l.flights[key] == f {
+		delete(l.flights, key)
+	}
+	l.mutex.Unlock()
+
+	f.entry, f.err = entry, err
+	close(f.done)
+}
+
+// set sets key to value in Redis, expiring after ttl, or never if ttl is 0,
+// then caches it. If ctx is done first, the cache is still updated once Redis
+// is
+func (l *loader) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return withContext(ctx, func() error {
+		unlock := l.lockWrites(key)
+		defer unlock()
+
+		err := l.o.breaker.call(func() error {
+			return l.redisClient.WithContext(ctx).Set(key, value, ttl).Err()
+		})
+		if err != nil {
+			return err
+		}
+
+		// bumping leaves anything else read from key behind
+		l.bump(key)
+		if !(read{path: key, stop: -1}).whole() {
+			return nil
+		}
+
+		l.cache.SetWithTTL(key, value, ttl)
+		if l.o.negativeCache != nil {
+			l.o.negativeCache.Delete(key)
+		}
+
+		return nil
+	})
+}
+
+// del deletes key from Redis and the cache, returning whether Redis had it.
+// If ctx is done first, the cache is still updated once Redis is
+func (l *loader) del(ctx context.Context, key string) (deleted bool, err error) {
+	err = withContext(ctx, func() error {
+		unlock := l.lockWrites(key)
+		defer unlock()
+
+		var count int64
+		err := l.o.breaker.call(func() (err error) {
+			count, err = l.redisClient.WithContext(ctx).Del(key).Result()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		deleted = count > 0
+
+		// bumping leaves anything else read from key behind
+		l.bump(key)
+		if !(read{path: key, stop: -1}).whole() {
+			return nil
+		}
+
+		l.cache.Delete(key)
+		rememberMiss(l.o.negativeCache, key)
+
+		return nil
+	})
+
+	// deleted is only set if the call returned first
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// fillBatch caches values fetched together with MGET, for keys at versions,
+// and forgets the keys Redis doesn't have, unless writes overtook them. Only
+// whole keys are cached, since other reads of a key aren't of its string value
+func (l *loader) fillBatch(keys []string, versions []uint64, values [][]byte, ttls []time.Duration, missing []bool, fetchTime time.Duration) {
+	for i, key := range keys {
+		rd := read{path: key, stop: -1}
+		if !rd.whole() {
+			continue
+		}
+
+		if values[i] != nil {
+			l.fill(rd, versions[i], values[i], ttls[i], fetchTime, "")
+		} else if missing[i] {
+			l.forget(key, rd, versions[i])
+		}
+	}
+}
+
+// fill caches a read's result, fetched at version, unless a write overtook
+// it, returning its entry, and whether it was cached
+func (l *loader) fill(rd read, version uint64, value []byte, ttl time.Duration, fetchTime time.Duration, contentType string) (*cache.Entry, bool) {
+	fetched := cache.Fetched{TTL: ttl, FetchTime: fetchTime, ContentType: contentType}
+	return l.cache.SetFetchedIf(rd.cacheKey(version), value, fetched, l.unchanged(rd, version))
+}
+
+// add caches a whole key's value, fetched at version, unless a write overtook
+// it, or the key is already cached, returning whether it was cached
+func (l *loader) add(rd read, version uint64, value []byte, ttl time.Duration) bool {
+	unchanged := l.unchanged(rd, version)
+	_, cached := l.cache.SetFetchedIf(rd.cacheKey(version), value, cache.Fetched{TTL: ttl}, func(current *cache.Entry) bool {
+		return current == nil && unchanged(current)
+	})
+
+	return cached
+}
+
+// forget removes a read's result from the cache, since Redis doesn't have it,
+// and remembers it in any negative cache, unless a write overtook the load
+func (l *loader) forget(key string, rd read, version uint64) {
+	if l.version(rd) != version {
+		return
+	}
+
+	l.cache.Delete(key)
+	if l.o.negativeCache != nil {
+		l.o.negativeCache.SetFetchedIf(key, []byte{}, cache.Fetched{}, l.unchanged(rd, version))
+	}
+}
+
+// generation returns the number of writes to key, along with any other keys
+// sharing its counter
+func (l *loader) generation(key string) uint64 {
+	return atomic.LoadUint64(&l.generations[l.counter(key)])
+}
+
+// bump counts a write to key. Writes bump the generation after writing to
+// Redis, and before writing to the cache, so loads that read the old value
+// either cache it before the write does, or not at all
+func (l *loader) bump(key string) {
+	atomic.AddUint64(&l.generations[l.counter(key)], 1)
+}
+
+// lockWrites locks writes to key, along with any other keys sharing its lock,
+// returning a func to unlock them
+func (l *loader) lockWrites(key string) func() {
+	mutex := &l.writeLocks[l.counter(key)%WRITE_LOCKS]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func (l *loader) counter(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32() % GENERATIONS
+}
+
+// version returns the sum of the generations of every key a read depends on:
+// its path, and the hash its path could name a field of. Generations only go
+// up, so the version changes whenever any of them does
+func (l *loader) version(rd read) uint64 {
+	version := l.generation(rd.path)
+	if slash := strings.LastIndex(rd.path, "/"); slash != -1 {
+		version += l.generation(rd.path[:slash])
+	}
+
+	return version
+}
+
+// cacheKey returns the key a read's result is currently cached under
+func (l *loader) cacheKey(rd read) string {
+	return rd.cacheKey(l.version(rd))
+}
+
+// unchanged returns a check, for cache.SetFetchedIf, that a read's version
+// is still version
+func (l *loader) unchanged(rd read, version uint64) func(*cache.Entry) bool {
+	return func(*cache.Entry) bool {
+		return l.version(rd) == version
+	}
+}
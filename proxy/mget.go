@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+	"github.com/go-redis/redis"
+)
+
+// MGET_PATH is where main serves MGetHandler, shadowing any Redis key named
+// "_mget"
+const MGET_PATH = "/_mget"
+
+const MGET_INVALID_BODY = "Error - body must be a JSON array of keys"
+
+// mgetResult is how MGetHandler reports each key. Strings are served as JSON
+// strings, and values of other types as the JSON they're served as on their
+// own
+type mgetResult struct {
+	Key   string          `json:"key"`
+	Found bool            `json:"found"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MGetHandler serves many keys at once on a Proxy of its own. See
+// Proxy.MGetHandler
+func MGetHandler(redisClient *redis.Client, c cache.Cache, opts ...Option) func(http.ResponseWriter, *http.Request) {
+	return New(redisClient, c, opts...).MGetHandler()
+}
+
+// MGetHandler serves many keys at once, listed as k query params of a GET,
+// or as a JSON array in the body of a POST. Keys are served from the cache
+// where possible, and the rest are fetched with one MGET, then cached like
+// single keys, with missing keys remembered by any negative cache. Keys MGET
+// can't read, of other types than strings, or naming hash fields, are loaded
+// like single keys. The response is an array with a result for each key, in
+// the order requested
+func (p *Proxy) MGetHandler() func(http.ResponseWriter, *http.Request) {
+	o, c, loader := p.o, p.cache, p.loader
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		switch r.Method {
+		case http.MethodGet:
+			keys = r.URL.Query()["k"]
+		case http.MethodPost:
+			err := json.NewDecoder(r.Body).Decode(&keys)
+			if err != nil {
+				writeError(w, r, ErrInvalidMGetBody)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeError(w, r, ErrMethodNotAllowed)
+			return
+		}
+
+		for _, key := range keys {
+			if key == "" {
+				writeError(w, r, ErrKeyEmpty)
+				return
+			}
+		}
+
+		results := make([]mgetResult, len(keys))
+		positions := make(map[string][]int)
+		var misses []string
+		for i, key := range keys {
+			results[i].Key = key
+
+			// keys that aren't cached under their own name are always
+			// fetched, since what's cached for their path isn't their value
+			whole := read{path: key, stop: -1}.whole()
+
+			if whole && o.negativeCache != nil && o.negativeCache.Get(key) != nil {
+				atomic.AddUint64(&o.counters.negativeHits, 1)
+				continue
+			}
+
+			var entry *cache.Entry
+			if whole {
+				entry = c.Get(key)
+			}
+
+			if entry != nil {
+				atomic.AddUint64(&o.counters.cacheHits, 1)
+
+				value, err := mgetEntry(entry)
+				if errIf(err, &w, r) {
+					return
+				}
+
+				results[i].Found, results[i].Value = true, value
+				continue
+			}
+
+			// keys requested more than once are fetched once
+			atomic.AddUint64(&o.counters.cacheMisses, 1)
+			if _, exists := positions[key]; !exists {
+				misses = append(misses, key)
+			}
+			positions[key] = append(positions[key], i)
+		}
+
+		if len(misses) > 0 {
+			ctx, cancel := o.deadline(r.Context())
+			defer cancel()
+
+			// versions are taken before fetching, so values read before
+			// a write aren't cached over it
+			versions := make([]uint64, len(misses))
+			for i, key := range misses {
+				versions[i] = loader.version(read{path: key, stop: -1})
+			}
+
+			// values are cached as soon as they're fetched, even if the
+			// client has gone away by then
+			var values [][]byte
+			var missing []bool
+			err := withContext(ctx, func() error {
+				var ttls []time.Duration
+
+				start := time.Now()
+				err := o.breaker.call(func() (err error) {
+					values, ttls, missing, err = fetchBatch(p.redisClient.WithContext(ctx), misses)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+
+				loader.fillBatch(misses, versions, values, ttls, missing, time.Since(start))
+				return nil
+			})
+			if errIf(backendError(err), &w, r) {
+				return
+			}
+
+			// MGET only reads strings, and reports paths naming hash
+			// fields as missing, so those are loaded like single keys
+			entries := make([]*cache.Entry, len(misses))
+			errs := make([]error, len(misses))
+			var wg sync.WaitGroup
+			for i, key := range misses {
+				if values[i] != nil || (missing[i] && read{path: key, stop: -1}.whole()) {
+					continue
+				}
+
+				wg.Add(1)
+				go func(i int, key string) {
+					defer wg.Done()
+					entries[i], errs[i] = loader.load(ctx, read{path: key, stop: -1})
+				}(i, key)
+			}
+			wg.Wait()
+
+			for i, key := range misses {
+				var value json.RawMessage
+				var err error
+				if values[i] != nil {
+					atomic.AddUint64(&o.counters.redisHits, 1)
+					value, err = mgetValue(values[i], nil)
+				} else if entries[i] != nil {
+					value, err = mgetEntry(entries[i])
+				} else if errs[i] == redis.Nil {
+					// the load counted the miss
+					continue
+				} else if errs[i] != nil {
+					err = backendError(errs[i])
+				} else {
+					atomic.AddUint64(&o.counters.redisMisses, 1)
+					continue
+				}
+
+				if errIf(err, &w, r) {
+					return
+				}
+
+				for _, j := range positions[key] {
+					results[j].Found, results[j].Value = true, value
+				}
+			}
+		}
+
+		body, err := json.Marshal(results)
+		if errIf(err, &w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", JSON_CONTENT_TYPE)
+		w.WriteHeader(200)
+		w.Write(body)
+	}
+}
+
+// mgetValue returns a string value as a JSON string
+func mgetValue(value []byte, err error) (json.RawMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(string(value))
+}
+
+// mgetEntry returns a cached value as JSON. Values of other types than strings
+// are already cached as JSON
+func mgetEntry(entry *cache.Entry) (json.RawMessage, error) {
+	if entry.ContentType == JSON_CONTENT_TYPE {
+		return entry.Decoded()
+	}
+
+	return mgetValue(entry.Decoded())
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"math"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+)
+
+// Option configures optional proxy behaviour
+type Option func(*options)
+
+type options struct {
+	negativeCache    cache.Cache
+	counters         *Counters
+	refreshBeta      float64
+	hideCacheHeaders bool
+	breaker          *Breaker
+	revalidateWindow time.Duration
+	maxStale         time.Duration
+	timeout          time.Duration
+}
+
+func newOptions(opts []Option) options {
+	// serve any stale entry the cache returns, unless told otherwise
+	o := options{revalidateWindow: math.MaxInt64}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// count regardless, so the handler doesn't need to check
+	if o.counters == nil {
+		o.counters = &Counters{}
+	}
+
+	return o
+}
+
+// WithNegativeCache remembers keys Redis doesn't have in c, so repeated
+// requests for a missing key get a 404 without going to Redis. Negative
+// entries are counted, expired and evicted by c, apart from cached values
+func WithNegativeCache(c cache.Cache) Option {
+	return func(o *options) {
+		o.negativeCache = c
+	}
+}
+
+// WithCounters counts cache and Redis hits and misses in counters
+func WithCounters(counters *Counters) Option {
+	return func(o *options) {
+		o.counters = counters
+	}
+}
+
+// WithEarlyRefresh refreshes cached values in the background before they
+// expire, with a chance that rises as expiry approaches, so that popular keys
+// don't all miss at once. beta scales how early refreshes happen, and 1 is a
+// good default. See cache.Entry.ExpiresEarly
+func WithEarlyRefresh(beta float64) Option {
+	return func(o *options) {
+		o.refreshBeta = beta
+	}
+}
+
+// WithoutCacheHeaders leaves out the X-Cache diagnostic headers, which are sent
+// by default. See setCacheHeaders
+func WithoutCacheHeaders() Option {
+	return func(o *options) {
+		o.hideCacheHeaders = true
+	}
+}
+
+// WithBreaker makes calls to Redis through b, failing them straight away while
+// it's open
+func WithBreaker(b *Breaker) Option {
+	return func(o *options) {
+		o.breaker = b
+	}
+}
+
+// WithStaleWhileRevalidate only serves stale entries while they're refreshed
+// if they expired at most window ago. Without it, any stale entry the cache
+// returns is served, so the cache's stale window decides. Staler entries can
+// still be served by WithMaxStale
+func WithStaleWhileRevalidate(window time.Duration) Option {
+	return func(o *options) {
+		o.revalidateWindow = window
+	}
+}
+
+// WithMaxStale serves cached entries that expired at most maxStale ago when
+// Redis can't be reached, or the breaker is open, instead of failing. The
+// cache's stale window has to be at least maxStale for it to keep them
+func WithMaxStale(maxStale time.Duration) Option {
+	return func(o *options) {
+		o.maxStale = maxStale
+	}
+}
+
+// WithTimeout limits the total time a request can spend on Redis, across all
+// the calls it makes, answering with a 504 once it's up. Each call is also
+// limited by the Redis client's own read timeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
@@ -3,6 +3,10 @@ package proxy
 import (
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/CyrusRoshan/simple-cache-server/cache"
 	"github.com/go-redis/redis"
@@ -12,60 +16,239 @@ const IMPROPERLY_ENCODED_PATH = "Error - improperly urlencoded url path"
 const KEY_EMPTY = "Error - key must not be empty"
 const KEY_NOT_FOUND = "Error - key not found"
 
-func RedisProxyHandler(redisClient *redis.Client, lru *cache.LRU) func(http.ResponseWriter, *http.Request) {
+// TIER_REDIS is the X-Cache-Tier header for values that weren't cached, next
+// to cache.TierMemory and cache.TierDisk. See setCacheHeaders
+const TIER_REDIS = "redis"
+
+// STALE_WARNING is the Warning header sent with stale responses (RFC 7234)
+const STALE_WARNING = `110 - "Response is Stale"`
+
+// REVALIDATION_FAILED_WARNING is the Warning header sent with stale responses
+// served because Redis couldn't be reached
+const REVALIDATION_FAILED_WARNING = `111 - "Revalidation Failed"`
+
+// Proxy serves Redis keys through a cache. Its handlers share one loader, so
+// keys fetched through one never overwrite writes through another
+type Proxy struct {
+	redisClient *redis.Client
+	cache       cache.Cache
+	o           options
+	loader      *loader
+	refresher   *refresher
+}
+
+// New returns a Proxy fetching keys from redisClient into c
+func New(redisClient *redis.Client, c cache.Cache, opts ...Option) *Proxy {
+	o := newOptions(opts)
+	loader := newLoader(redisClient, c, o)
+
+	return &Proxy{
+		redisClient: redisClient,
+		cache:       c,
+		o:           o,
+		loader:      loader,
+		refresher:   newRefresher(loader),
+	}
+}
+
+// RedisProxyHandler serves single keys on a Proxy of its own. See Handler
+func RedisProxyHandler(redisClient *redis.Client, c cache.Cache, opts ...Option) func(http.ResponseWriter, *http.Request) {
+	return New(redisClient, c, opts...).Handler()
+}
+
+// Handler serves reads and writes of single keys
+func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
+	o, c, loader, refresher := p.o, p.cache, p.loader, p.refresher
+
 	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		default:
+			w.Header().Set("Allow", ALLOWED_METHODS)
+			writeError(w, r, ErrMethodNotAllowed)
+			return
+		}
+
 		path, err := url.QueryUnescape(r.URL.Path)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte(IMPROPERLY_ENCODED_PATH))
+			writeError(w, r, ErrImproperlyEncoded)
 			return
 		}
 
 		if len(path) <= 1 {
-			w.WriteHeader(400)
-			w.Write([]byte(KEY_EMPTY))
+			writeError(w, r, ErrKeyEmpty)
 			return
 		}
 
-		key := path[1:]
+		// Redis calls are given up on when the client goes away, or the
+		// request runs out of time
+		ctx, cancel := o.deadline(r.Context())
+		defer cancel()
+
+		switch r.Method {
+		case http.MethodPut:
+			handlePut(ctx, w, r, loader, path[1:])
+			return
+		case http.MethodDelete:
+			handleDelete(ctx, w, r, loader, path[1:])
+			return
+		}
+
+		rd, err := readFor(path[1:], r.URL.Query())
+		if err != nil {
+			writeError(w, r, ErrInvalidRange)
+			return
+		}
+
+		key := loader.cacheKey(rd)
+
+		if o.negativeCache != nil && o.negativeCache.Get(key) != nil {
+			atomic.AddUint64(&o.counters.negativeHits, 1)
+			o.setCacheHeaders(w, CACHE_NEGATIVE, "", nil)
+
+			writeError(w, r, ErrKeyNotFound)
+			return
+		}
+
+		// entries too stale to serve while they're refreshed are only served
+		// if Redis can't be reached, so they're peeked at, and don't count as
+		// hits or uses until they are
+		var cachedVal, fallback *cache.Entry
+		var stale bool
+		if peeked, peekedStale := c.PeekStale(key); peeked != nil && peekedStale && time.Since(peeked.Expires) > o.revalidateWindow {
+			fallback = peeked
+		} else {
+			cachedVal, stale = c.GetStale(key)
+		}
 
-		cachedVal := lru.Get(key)
 		if cachedVal != nil {
-			result, err := cachedVal.Result()
-			if errIf(err, &w, r) {
-				return
+			atomic.AddUint64(&o.counters.cacheHits, 1)
+
+			xCache := CACHE_HIT
+			if stale {
+				refresher.refresh(rd)
+
+				xCache = CACHE_STALE
+				w.Header().Set("Warning", STALE_WARNING)
+			} else if cachedVal.ExpiresEarly(o.refreshBeta, time.Now()) && refresher.refresh(rd) {
+				atomic.AddUint64(&o.counters.earlyRefreshes, 1)
 			}
 
-			w.WriteHeader(200)
-			w.Write([]byte(result))
+			o.setCacheHeaders(w, xCache, cachedVal.Tier, cachedVal)
+			serve(w, r, cachedVal)
 			return
 		}
 
-		updatedValue := redisClient.Get(key)
-		result, err := updatedValue.Result()
+		atomic.AddUint64(&o.counters.cacheMisses, 1)
+
+		entry, err := loader.load(ctx, rd)
 		if err == redis.Nil {
-			w.WriteHeader(404)
-			w.Write([]byte(KEY_NOT_FOUND))
+			o.setCacheHeaders(w, CACHE_MISS, "", nil)
+
+			writeError(w, r, ErrKeyNotFound)
+			return
+		} else if err != nil && fallback != nil && unavailable(err) && time.Since(fallback.Expires) <= o.maxStale {
+			atomic.AddUint64(&o.counters.staleFallbacks, 1)
+			o.setCacheHeaders(w, CACHE_STALE, fallback.Tier, fallback)
+
+			w.Header().Set("Warning", REVALIDATION_FAILED_WARNING)
+			serve(w, r, fallback)
 			return
-		} else if errIf(err, &w, r) {
+		} else if errIf(backendError(err), &w, r) {
 			return
 		}
 
-		lru.Set(key, updatedValue)
+		o.setCacheHeaders(w, CACHE_MISS, TIER_REDIS, entry)
+		serve(w, r, entry)
+		return
+	}
+}
+
+// serve writes an entry's value, along with headers for any caches between
+// the proxy and the client, answering 304 if the client's copy is current
+func serve(w http.ResponseWriter, r *http.Request, entry *cache.Entry) {
+	if entry.ContentType != "" {
+		w.Header().Set("Content-Type", entry.ContentType)
+	}
+
+	value, decoded, err := encodeFor(w, r, entry)
+	if errIf(err, &w, r) {
+		return
+	}
+
+	etag := etagFor(entry, decoded)
+	w.Header().Set("ETag", etag)
+	setFreshness(w, entry, time.Now())
 
-		w.WriteHeader(200)
-		w.Write([]byte(result))
+	if notModified(r, etag) {
+		w.WriteHeader(304)
 		return
 	}
+
+	w.WriteHeader(200)
+	w.Write(value)
 }
 
-func errIf(err error, w *http.ResponseWriter, r *http.Request) bool {
-	if err != nil {
-		(*w).WriteHeader(500)
-		(*w).Write([]byte(err.Error()))
+// rememberMiss caches a key Redis doesn't have, if negative caching is on
+func rememberMiss(negativeCache cache.Cache, key string) {
+	if negativeCache != nil {
+		negativeCache.Set(key, []byte{})
+	}
+}
+
+// encodeFor returns a cached value in a form the client accepts, along with
+// whether it was decompressed: gzipped values are sent as they're stored to
+// clients that accept gzip, and any other compressed value is decompressed
+func encodeFor(w http.ResponseWriter, r *http.Request, entry *cache.Entry) ([]byte, bool, error) {
+	if entry.Encoding == "" {
+		return entry.Value, false, nil
+	}
+
+	// the response depends on Accept-Encoding from now on, for any caches
+	// between the proxy and the client
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if entry.Encoding == cache.CodecGzip && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		return entry.Value, false, nil
+	}
+
+	value, err := entry.Decoded()
+	return value, true, err
+}
 
-		return true
+// acceptsGzip returns whether a request's Accept-Encoding allows gzip, either
+// by name or with a wildcard
+func acceptsGzip(r *http.Request) bool {
+	return accepts(r.Header.Get("Accept-Encoding"), "gzip", "*")
+}
+
+// accepts returns whether an Accept style header allows a value, given the
+// names it could be listed under, most specific first, like "gzip" and "*".
+// The most specific name listed decides, so naming a value overrides any
+// wildcard
+func accepts(header string, names ...string) bool {
+	best, acceptable := len(names), false
+	for _, accepted := range strings.Split(header, ",") {
+		params := strings.Split(accepted, ";")
+		name := strings.TrimSpace(params[0])
+
+		for i := 0; i < best; i++ {
+			if name != names[i] {
+				continue
+			}
+
+			// a quality of 0 means the value isn't acceptable
+			best, acceptable = i, true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					quality, err := strconv.ParseFloat(param[2:], 64)
+					acceptable = err != nil || quality > 0
+				}
+			}
+		}
 	}
 
-	return false
+	return acceptable
 }
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// refresher refreshes stale or soon to expire cache entries from Redis in the
+// background, with at most one refresh in flight per key
+type refresher struct {
+	loader   *loader
+	mutex    *sync.Mutex
+	inFlight map[string]bool
+}
+
+func newRefresher(l *loader) *refresher {
+	return &refresher{
+		loader:   l,
+		mutex:    &sync.Mutex{},
+		inFlight: make(map[string]bool),
+	}
+}
+
+// refresh starts refreshing a read's cached result, unless a refresh is already in flight,
+// returning whether it started one. If Redis can't be reached, the cached
+// value is kept, and served until it's too stale to serve
+func (r *refresher) refresh(rd read) bool {
+	key := r.loader.cacheKey(rd)
+
+	r.mutex.Lock()
+	if r.inFlight[key] {
+		r.mutex.Unlock()
+		return false
+	}
+	r.inFlight[key] = true
+	r.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			r.mutex.Lock()
+			delete(r.inFlight, key)
+			r.mutex.Unlock()
+		}()
+
+		r.loader.load(context.Background(), rd)
+	}()
+
+	return true
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+)
+
+// STATS_PATH is where main serves StatsHandler, shadowing any Redis key
+// named "_stats"
+const STATS_PATH = "/_stats"
+
+// Stats is a snapshot of where the proxy found requested keys
+type Stats struct {
+	CacheHits    uint64 `json:"cacheHits"`    // served from the cache
+	NegativeHits uint64 `json:"negativeHits"` // answered 404 from the negative cache
+	CacheMisses  uint64 `json:"cacheMisses"`  // looked up in Redis
+	RedisHits    uint64 `json:"redisHits"`    // fetches that found the key in Redis
+	RedisMisses  uint64 `json:"redisMisses"`  // fetches that got a redis.Nil result
+
+	EarlyRefreshes uint64 `json:"earlyRefreshes"` // cache hits that refreshed the value before it expired
+	Coalesced      uint64 `json:"coalesced"`      // Redis fetches shared with a fetch already in flight
+	StaleFallbacks uint64 `json:"staleFallbacks"` // cache misses served a stale value, since Redis couldn't be reached
+}
+
+// Counters count where the proxy found requested keys, atomically, so they
+// can be read while requests are being served
+type Counters struct {
+	cacheHits    uint64
+	negativeHits uint64
+	cacheMisses  uint64
+	redisHits    uint64
+	redisMisses  uint64
+
+	earlyRefreshes uint64
+	coalesced      uint64
+	staleFallbacks uint64
+}
+
+func (c *Counters) Stats() Stats {
+	return Stats{
+		CacheHits:    atomic.LoadUint64(&c.cacheHits),
+		NegativeHits: atomic.LoadUint64(&c.negativeHits),
+		CacheMisses:  atomic.LoadUint64(&c.cacheMisses),
+		RedisHits:    atomic.LoadUint64(&c.redisHits),
+		RedisMisses:  atomic.LoadUint64(&c.redisMisses),
+
+		EarlyRefreshes: atomic.LoadUint64(&c.earlyRefreshes),
+		Coalesced:      atomic.LoadUint64(&c.coalesced),
+		StaleFallbacks: atomic.LoadUint64(&c.staleFallbacks),
+	}
+}
+
+func (c *Counters) Reset() {
+	atomic.StoreUint64(&c.cacheHits, 0)
+	atomic.StoreUint64(&c.negativeHits, 0)
+	atomic.StoreUint64(&c.cacheMisses, 0)
+	atomic.StoreUint64(&c.redisHits, 0)
+	atomic.StoreUint64(&c.redisMisses, 0)
+	atomic.StoreUint64(&c.earlyRefreshes, 0)
+	atomic.StoreUint64(&c.coalesced, 0)
+	atomic.StoreUint64(&c.staleFallbacks, 0)
+}
+
+// StatsHandler serves the proxy's and the cache's counters as JSON, leaving
+// out the cache's if it isn't a cache.StatsReporter
+func StatsHandler(c cache.Cache, counters *Counters) func(http.ResponseWriter, *http.Request) {
+	reporter, _ := c.(cache.StatsReporter)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cacheStats *cache.Stats
+		if reporter != nil {
+			stats := reporter.Stats()
+			cacheStats = &stats
+		}
+
+		body, err := json.Marshal(struct {
+			Proxy Stats        `json:"proxy"`
+			Cache *cache.Stats `json:"cache,omitempty"`
+		}{counters.Stats(), cacheStats})
+
+		if errIf(err, &w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(body)
+	}
+}
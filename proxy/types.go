@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+	"github.com/go-redis/redis"
+)
+
+var ErrUnsupportedType = errors.New("unsupported Redis type")
+
+const INVALID_RANGE = "Error - start and stop must be integers"
+
+// JSON_CONTENT_TYPE is the Content-Type of values read from Redis types other
+// than strings
+const JSON_CONTENT_TYPE = "application/json"
+
+// read is what a request reads from Redis: the key at path, or else the field
+// after path's last "/" in the hash before it. Lists and sorted sets are read
+// from start to stop, inclusive, counting back from the end if negative
+type read struct {
+	path  string
+	start int64
+	stop  int64
+}
+
+// readFor returns what a request for path reads, along with the start and stop
+// query params, which default to the whole list or sorted set
+func readFor(path string, query url.Values) (rd read, err error) {
+	rd = read{path: path, start: 0, stop: -1}
+
+	if start := query.Get("start"); start != "" {
+		rd.start, err = strconv.ParseInt(start, 10, 64)
+		if err != nil {
+			return rd, err
+		}
+	}
+
+	if stop := query.Get("stop"); stop != "" {
+		rd.stop, err = strconv.ParseInt(stop, 10, 64)
+		if err != nil {
+			return rd, err
+		}
+	}
+
+	return rd, nil
+}
+
+// whole returns whether a read is of a whole key, cached under its own name,
+// rather than part of a list or sorted set, a path that could name a hash
+// field, or a key starting with a NUL byte
+func (rd read) whole() bool {
+	return rd.start == 0 && rd.stop == -1 && !strings.Contains(rd.path, "/") && !strings.HasPrefix(rd.path, cache.TransientPrefix)
+}
+
+// cacheKey is the key a read's result is cached under, at version. Whole keys
+// are cached under their own name, so writes, /_mget and warm-up share their
+// entries. Other reads are cached under a transient name, followed by their
+// version, range and path, so no two reads can share an entry, and writes to
+// the keys they depend on leave what they cached behind. Versions restart
+// from 0, so those entries mustn't outlive the process
+func (rd read) cacheKey(version uint64) string {
+	if rd.whole() {
+		return rd.path
+	}
+
+	return fmt.Sprintf("%s%d:%d:%d:%s", cache.TransientPrefix, version, rd.start, rd.stop, rd.path)
+}
+
+// scoredMember is how sorted set members are served
+type scoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// fetch reads a key's value from Redis along with its remaining TTL, which is
+// 0 if the key doesn't expire. Strings are served as they're stored, in one
+// round trip. Other types take a second round trip once TYPE has named them,
+// and are served as JSON, with contentType set
+func fetch(redisClient *redis.Client, rd read) (value []byte, contentType string, ttl time.Duration, err error) {
+	pipe := redisClient.Pipeline()
+	defer pipe.Close()
+
+	keyType := pipe.Type(rd.path)
+	get := pipe.Get(rd.path)
+	pttl := pipe.PTTL(rd.path)
+
+	// GET fails on anything but strings, so only TYPE's error matters here
+	pipe.Exec()
+	if keyType.Err() != nil {
+		return nil, "", 0, keyType.Err()
+	}
+
+	switch keyType.Val() {
+	case "none":
+		return fetchField(redisClient, rd)
+	case "string":
+		value, err = get.Bytes()
+	default:
+		contentType = JSON_CONTENT_TYPE
+		value, err = fetchJSON(redisClient, keyType.Val(), rd)
+	}
+
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return value, contentType, remaining(pttl), nil
+}
+
+// fetchJSON reads a key of any type but string, as JSON: hashes as an object,
+// lists and sets as arrays, and sorted sets as an array of members and their
+// scores, lowest score first. Sets are sorted, since Redis keeps no order
+func fetchJSON(redisClient *redis.Client, keyType string, rd read) ([]byte, error) {
+	switch keyType {
+	case "hash":
+		fields, err := redisClient.HGetAll(rd.path).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(fields)
+	case "list":
+		elements, err := redisClient.LRange(rd.path, rd.start, rd.stop).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		return jsonArray(elements)
+	case "set":
+		members, err := redisClient.SMembers(rd.path).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(members)
+		return jsonArray(members)
+	case "zset":
+		scored, err := redisClient.ZRangeWithScores(rd.path, rd.start, rd.stop).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		members := make([]scoredMember, len(scored))
+		for i, z := range scored {
+			members[i] = scoredMember{Member: fmt.Sprint(z.Member), Score: z.Score}
+		}
+
+		return json.Marshal(members)
+	}
+
+	return nil, ErrUnsupportedType
+}
+
+// fetchField reads a read's path as key/field, the field of a hash, as a JSON
+// string. Paths that don't name a field of a hash get redis.Nil
+func fetchField(redisClient *redis.Client, rd read) (value []byte, contentType string, ttl time.Duration, err error) {
+	slash := strings.LastIndex(rd.path, "/")
+	if slash == -1 {
+		return nil, "", 0, redis.Nil
+	}
+
+	key, field := rd.path[:slash], rd.path[slash+1:]
+
+	pipe := redisClient.Pipeline()
+	defer pipe.Close()
+
+	keyType := pipe.Type(key)
+	hget := pipe.HGet(key, field)
+	pttl := pipe.PTTL(key)
+
+	// HGET fails on anything but hashes, so only TYPE's error matters here
+	pipe.Exec()
+	if keyType.Err() != nil {
+		return nil, "", 0, keyType.Err()
+	}
+
+	if keyType.Val() != "hash" {
+		return nil, "", 0, redis.Nil
+	}
+
+	fieldValue, err := hget.Result()
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	value, err = json.Marshal(fieldValue)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return value, JSON_CONTENT_TYPE, remaining(pttl), nil
+}
+
+// jsonArray marshals elements, as [] rather than null if there are none
+func jsonArray(elements []string) ([]byte, error) {
+	if elements == nil {
+		elements = []string{}
+	}
+
+	return json.Marshal(elements)
+}
+
+// remaining returns a PTTL result as a TTL, which is 0 for keys without one
+func remaining(pttl *redis.DurationCmd) time.Duration {
+	// PTTL gives negative values for keys without a TTL
+	if pttl.Val() > 0 {
+		return pttl.Val()
+	}
+
+	return 0
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/CyrusRoshan/simple-cache-server/cache"
+	"github.com/go-redis/redis"
+)
+
+// WARMUP_BATCH is how many keys warm-up fetches per round trip to Redis
+const WARMUP_BATCH = 100
+
+// READY_PATH is where main serves ReadyHandler, shadowing any Redis key named
+// "_ready"
+const READY_PATH = "/_ready"
+
+// KeySource lists the keys to warm a cache with
+type KeySource interface {
+	// Next returns up to n more keys, or no keys once there are none left
+	Next(n int) ([]string, error)
+}
+
+type readerKeys struct {
+	scanner *bufio.Scanner
+}
+
+// ReaderKeys lists the keys in r, one per line, skipping blank lines
+func ReaderKeys(r io.Reader) KeySource {
+	return &readerKeys{scanner: bufio.NewScanner(r)}
+}
+
+func (k *readerKeys) Next(n int) ([]string, error) {
+	keys := make([]string, 0, n)
+	for len(keys) < n && k.scanner.Scan() {
+		if key := strings.TrimSpace(k.scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, k.scanner.Err()
+}
+
+type scanKeys struct {
+	redisClient *redis.Client
+	pattern     string
+	cursor      uint64
+	keys        []string
+	done        bool
+}
+
+// ScanKeys lists the keys in Redis matching pattern, using SCAN, so Redis
+// isn't blocked like it would be by KEYS. Keys added or removed while scanning
+// may or may not be listed, and a key may be listed more than once
+func ScanKeys(redisClient *redis.Client, pattern string) KeySource {
+	return &scanKeys{redisClient: redisClient, pattern: pattern}
+}
+
+func (k *scanKeys) Next(n int) ([]string, error) {
+	// a SCAN call can return no keys before the scan is done
+	for len(k.keys) < n && !k.done {
+		keys, cursor, err := k.redisClient.Scan(k.cursor, k.pattern, int64(n)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys = append(k.keys, keys...)
+		k.cursor = cursor
+		k.done = cursor == 0
+	}
+
+	if n > len(k.keys) {
+		n = len(k.keys)
+	}
+
+	keys := k.keys[:n]
+	k.keys = k.keys[n:]
+
+	return keys, nil
+}
+
+// Warm warms c on a Proxy of its own. See Proxy.Warm
+func Warm(redisClient *redis.Client, c cache.Cache, keys KeySource, budget time.Duration) (warmed int, err error) {
+	return New(redisClient, c).Warm(keys, budget)
+}
+
+// Warm fills the cache with the values of keys from Redis, WARMUP_BATCH keys
+// per pipelined MGET, along with each key's TTL. Keys that are already cached,
+// or written while they're fetched, are left as they are. Batches are cut to
+// the room left in a cache.Bounded cache, so warm-up doesn't evict anything,
+// and it stops when keys run out, when the budget is spent, or once the cache
+// is full. A budget of 0 means no time limit. warmed counts the keys warm-up
+// cached that are still cached once it's done
+func (p *Proxy) Warm(keys KeySource, budget time.Duration) (warmed int, err error) {
+	var added []string
+	start := time.Now()
+
+	// caches that can't say how full they are may evict to fit the batches
+	bounded, _ := p.cache.(cache.Bounded)
+
+	for budget == 0 || time.Since(start) < budget {
+		size := WARMUP_BATCH
+		if bounded != nil {
+			if room := bounded.Room(); room != -1 && room < size {
+				size = room
+			}
+		}
+
+		if size == 0 {
+			break
+		}
+
+		var batch []string
+		batch, err = keys.Next(size)
+		if err != nil || len(batch) == 0 {
+			break
+		}
+
+		versions := make([]uint64, len(batch))
+		for i, key := range batch {
+			versions[i] = p.loader.version(read{path: key, stop: -1})
+		}
+
+		var values [][]byte
+		var ttls []time.Duration
+		values, ttls, _, err = fetchBatch(p.redisClient, batch)
+		if err != nil {
+			break
+		}
+
+		batchStart := len(added)
+		for i, key := range batch {
+			// keys can disappear from Redis between listing and fetching,
+			// and keys that aren't cached under their own name are left
+			// for their first read
+			rd := read{path: key, stop: -1}
+			if values[i] != nil && rd.whole() && p.loader.add(rd, versions[i], values[i], ttls[i]) {
+				added = append(added, key)
+			}
+		}
+
+		// an estimated byte room, or a shard with less room than the rest,
+		// can still let a batch evict what it added, once the cache is full
+		full := false
+		for _, key := range added[batchStart:] {
+			full = full || p.cache.Peek(key) == nil
+		}
+
+		if full {
+			break
+		}
+	}
+
+	for _, key := range added {
+		if p.cache.Peek(key) != nil {
+			warmed++
+		}
+	}
+
+	return warmed, err
+}
+
+// fetchBatch gets the values and remaining TTLs of keys in one round trip.
+// Values are nil for missing keys, and for keys that aren't strings, which
+// missing tells apart
+func fetchBatch(redisClient *redis.Client, keys []string) (values [][]byte, ttls []time.Duration, missing []bool, err error) {
+	pipe := redisClient.Pipeline()
+	defer pipe.Close()
+
+	mget := pipe.MGet(keys...)
+	pttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		pttls[i] = pipe.PTTL(key)
+	}
+
+	_, err = pipe.Exec()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	values = make([][]byte, len(keys))
+	ttls = make([]time.Duration, len(keys))
+	missing = make([]bool, len(keys))
+	for i, value := range mget.Val() {
+		// MGET only reads strings, so other types are skipped like missing
+		// keys, and cached when they're first requested instead
+		if s, ok := value.(string); ok {
+			values[i] = []byte(s)
+		}
+
+		ttls[i] = remaining(pttls[i])
+
+		// PTTL gives -2 for keys that don't exist
+		missing[i] = values[i] == nil && pttls[i].Val() == -2*time.Millisecond
+	}
+
+	return values, ttls, missing, nil
+}
+
+// Readiness records whether the proxy has finished starting up
+type Readiness struct {
+	ready int32
+}
+
+func (r *Readiness) SetReady() {
+	atomic.StoreInt32(&r.ready, 1)
+}
+
+func (r *Readiness) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// ReadyHandler answers 200 once readiness is set, and 503 until then, so load
+// balancers can hold traffic back while the cache warms up
+func ReadyHandler(readiness *Readiness) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !readiness.Ready() {
+			w.WriteHeader(503)
+			w.Write([]byte("not ready"))
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte("ready"))
+	}
+}
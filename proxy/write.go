@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ALLOWED_METHODS is the Allow header sent with 405 responses
+const ALLOWED_METHODS = "GET, HEAD, PUT, DELETE"
+
+const INVALID_TTL = "Error - ttl must be a positive number of ms"
+
+// handlePut sets key to the request body in Redis, and in the cache, expiring
+// after the ttl query param in ms, if there is one
+func handlePut(ctx context.Context, w http.ResponseWriter, r *http.Request, l *loader, key string) {
+	var ttl time.Duration
+	if ttlParam := r.URL.Query().Get("ttl"); ttlParam != "" {
+		ttlInt, err := strconv.ParseInt(ttlParam, 10, 64)
+		if err != nil || ttlInt <= 0 {
+			writeError(w, r, ErrInvalidTTL)
+			return
+		}
+
+		ttl = time.Duration(ttlInt) * time.Millisecond
+	}
+
+	value, err := ioutil.ReadAll(r.Body)
+	if errIf(err, &w, r) {
+		return
+	}
+
+	err = l.set(ctx, key, value, ttl)
+	if errIf(backendError(err), &w, r) {
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// handleDelete deletes key from Redis and the cache
+func handleDelete(ctx context.Context, w http.ResponseWriter, r *http.Request, l *loader, key string) {
+	deleted, err := l.del(ctx, key)
+	if errIf(backendError(err), &w, r) {
+		return
+	}
+
+	if !deleted {
+		writeError(w, r, ErrKeyNotFound)
+		return
+	}
+
+	w.WriteHeader(204)
+}